@@ -0,0 +1,52 @@
+package sshbox
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SessionAgentForwarding returns a session option requesting agent forwarding on session,
+// SSHConf.Agent is forwarded if set, otherwise the agent at SSHAuthSock or SSH_AUTH_SOCK.
+// Sessions of InteractiveSSH and CommanderSSH request it by themselves when SSHConf.ForwardAgent is set.
+func (t *SSHBox) SessionAgentForwarding() SSHSessionOptions {
+	return func(session *ssh.Session) error {
+		err := t.registerAgentForwarding(t.SSHClient())
+		if err != nil {
+			return err
+		}
+		return agent.RequestAgentForwarding(session)
+	}
+}
+
+// registerAgentForwarding makes client answer agent channels opened by server, once per client
+func (t *SSHBox) registerAgentForwarding(client *ssh.Client) error {
+	t.agentForwardMu.Lock()
+	defer t.agentForwardMu.Unlock()
+	if t.agentForwardClient == client {
+		return nil
+	}
+	var err error
+	switch {
+	case t.config.NoSSHAgent:
+		return fmt.Errorf("no agent to forward, NoSSHAgent is set")
+	case t.config.Agent != nil:
+		err = agent.ForwardToAgent(client, t.config.Agent)
+	default:
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if t.config.SSHAuthSock != nil {
+			sock = *t.config.SSHAuthSock
+		}
+		if sock == "" {
+			return fmt.Errorf("no agent to forward, SSH_AUTH_SOCK is not set")
+		}
+		err = agent.ForwardToRemote(client, sock)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to forward agent: %s", err)
+	}
+	t.agentForwardClient = client
+	return nil
+}
@@ -0,0 +1,245 @@
+package sshbox
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentKeyConstraints restrict use of keys added to an AgentKeyring
+type AgentKeyConstraints struct {
+	// Lifetime is the duration after which key is removed, key is kept forever when zero
+	Lifetime time.Duration
+	// ConfirmBeforeUse asks AgentKeyring.Confirm before each signature with key
+	ConfirmBeforeUse bool
+}
+
+// AgentKeyring is an in-process ssh agent holding keys in memory, it can be served on a unix socket
+// for other tools (git, rsync, ssh) and given to SSHConf.Agent
+type AgentKeyring struct {
+	agent.ExtendedAgent
+	// Confirm is asked before signing with a key added with ConfirmBeforeUse constraint,
+	// signing is refused when it returns false or is not set
+	Confirm func(key ssh.PublicKey, comment string) bool
+
+	mu         sync.Mutex
+	confirm    map[string]string
+	clientOnce sync.Once
+	client     agent.ExtendedAgent
+	listener   net.Listener
+	socketPath string
+	tempDir    string
+}
+
+// NewAgentKeyring creates an empty in-process agent built on agent.NewKeyring
+func NewAgentKeyring() *AgentKeyring {
+	return &AgentKeyring{
+		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		confirm:       make(map[string]string),
+	}
+}
+
+// AddKeysFromConf adds PrivateKey and Identities of conf with their certificate, identities given as ssh.Signer are skipped
+// as their private key can't be exported
+func (k *AgentKeyring) AddKeysFromConf(conf SSHConf, constraints AgentKeyConstraints) error {
+	cert, err := conf.userCertificate()
+	if err != nil {
+		return err
+	}
+	for i, identity := range conf.identities() {
+		if identity.Signer != nil {
+			logger.Warningf("Identity %s is a signer and can't be added to agent, skipping", identity)
+			continue
+		}
+		key, err := conf.identityKey(identity)
+		if err != nil {
+			return fmt.Errorf("Failed to load identity %s: %s", identity, err)
+		}
+		err = k.Add(agent.AddedKey{
+			PrivateKey:       key,
+			Comment:          identity.String(),
+			LifetimeSecs:     uint32(constraints.Lifetime.Seconds()),
+			ConfirmBeforeUse: constraints.ConfirmBeforeUse,
+		})
+		if err != nil {
+			return err
+		}
+		identityCert := cert
+		if identity.Path != "" && (i > 0 || conf.PrivateKey == "") {
+			identityCert, err = identityCertificate(identity.Path)
+			if err != nil {
+				return fmt.Errorf("Failed to load certificate of identity %s: %s", identity, err)
+			}
+		}
+		if identityCert == nil {
+			continue
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return err
+		}
+		if !containsKey([]ssh.PublicKey{signer.PublicKey()}, identityCert.Key) {
+			continue
+		}
+		err = k.Add(agent.AddedKey{
+			PrivateKey:       key,
+			Certificate:      identityCert,
+			Comment:          identity.String(),
+			LifetimeSecs:     uint32(constraints.Lifetime.Seconds()),
+			ConfirmBeforeUse: constraints.ConfirmBeforeUse,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add adds a key, keeping track of confirm constraint which is not handled by agent.NewKeyring
+func (k *AgentKeyring) Add(key agent.AddedKey) error {
+	err := k.ExtendedAgent.Add(key)
+	if err != nil {
+		return err
+	}
+	if !key.ConfirmBeforeUse {
+		return nil
+	}
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	var pubKey ssh.PublicKey = signer.PublicKey()
+	if key.Certificate != nil {
+		pubKey = key.Certificate
+	}
+	k.mu.Lock()
+	k.confirm[string(pubKey.Marshal())] = key.Comment
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *AgentKeyring) Remove(key ssh.PublicKey) error {
+	k.mu.Lock()
+	delete(k.confirm, string(key.Marshal()))
+	k.mu.Unlock()
+	return k.ExtendedAgent.Remove(key)
+}
+
+func (k *AgentKeyring) RemoveAll() error {
+	k.mu.Lock()
+	k.confirm = make(map[string]string)
+	k.mu.Unlock()
+	return k.ExtendedAgent.RemoveAll()
+}
+
+func (k *AgentKeyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return k.SignWithFlags(key, data, 0)
+}
+
+func (k *AgentKeyring) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	err := k.confirmUse(key)
+	if err != nil {
+		return nil, err
+	}
+	return k.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+// Signers returns signers going through Sign so that constraints are checked
+func (k *AgentKeyring) Signers() ([]ssh.Signer, error) {
+	k.clientOnce.Do(func() {
+		k.client = agent.NewClient(agentPipe(k))
+	})
+	return k.client.Signers()
+}
+
+func (k *AgentKeyring) confirmUse(key ssh.PublicKey) error {
+	k.mu.Lock()
+	comment, ok := k.confirm[string(key.Marshal())]
+	k.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if k.Confirm == nil || !k.Confirm(key, comment) {
+		return errors.New("agent: use of key refused")
+	}
+	return nil
+}
+
+// Listen serves keyring on a unix socket at socketPath, or in a new temporary directory when empty,
+// and returns socket path to use as SSH_AUTH_SOCK
+func (k *AgentKeyring) Listen(socketPath string) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.listener != nil {
+		return "", fmt.Errorf("agent keyring already listening on %s", k.socketPath)
+	}
+	if socketPath == "" {
+		tempDir, err := os.MkdirTemp("", "sshbox-agent-")
+		if err != nil {
+			return "", err
+		}
+		k.tempDir = tempDir
+		socketPath = filepath.Join(tempDir, "agent.sock")
+	}
+	listener, err := listenUnixSocket(socketPath, 0600)
+	if err != nil {
+		return "", err
+	}
+	k.listener = listener
+	k.socketPath = socketPath
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(k, conn)
+			}()
+		}
+	}()
+	logger.Debugf("Agent keyring listening on %s", socketPath)
+	return socketPath, nil
+}
+
+// SocketPath returns path of unix socket keyring is served on, empty if not listening
+func (k *AgentKeyring) SocketPath() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.socketPath
+}
+
+// Close stops serving keyring on unix socket and removes all keys
+func (k *AgentKeyring) Close() error {
+	k.mu.Lock()
+	if k.listener != nil {
+		k.listener.Close()
+		os.Remove(k.socketPath)
+		k.listener = nil
+		k.socketPath = ""
+	}
+	if k.tempDir != "" {
+		os.RemoveAll(k.tempDir)
+		k.tempDir = ""
+	}
+	k.mu.Unlock()
+	return k.RemoveAll()
+}
+
+// agentPipe serves an agent in memory and returns a connection to it
+func agentPipe(keyring agent.ExtendedAgent) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		agent.ServeAgent(keyring, server)
+	}()
+	return client
+}
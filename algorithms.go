@@ -0,0 +1,195 @@
+package sshbox
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Presets which can be given in place of algorithm names in Ciphers, KeyExchanges, MACs and HostKeyAlgorithms of SSHConf
+const (
+	// AlgorithmsDefault are algorithms used by golang.org/x/crypto/ssh when none are set
+	AlgorithmsDefault = "default"
+	// AlgorithmsModern are only algorithms considered secure, for hardened servers
+	AlgorithmsModern = "modern"
+	// AlgorithmsCompat are all supported algorithms including legacy ones (e.g. diffie-hellman-group1-sha1,
+	// ssh-rsa, cbc ciphers), for old servers and network gear
+	AlgorithmsCompat = "compat"
+)
+
+type algorithmKind struct {
+	name    string
+	presets map[string][]string
+}
+
+var (
+	cipherAlgorithms = algorithmKind{
+		name: "cipher",
+		presets: map[string][]string{
+			AlgorithmsDefault: {
+				"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+				"aes128-ctr", "aes192-ctr", "aes256-ctr",
+			},
+			AlgorithmsModern: {
+				"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com",
+				"aes256-ctr", "aes192-ctr", "aes128-ctr",
+			},
+			AlgorithmsCompat: {
+				"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+				"aes128-ctr", "aes192-ctr", "aes256-ctr",
+				"aes128-cbc", "3des-cbc",
+				"arcfour256", "arcfour128", "arcfour",
+			},
+		},
+	}
+	kexAlgorithms = algorithmKind{
+		name: "key exchange",
+		presets: map[string][]string{
+			AlgorithmsDefault: {
+				"curve25519-sha256", "curve25519-sha256@libssh.org",
+				"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+				"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+			},
+			AlgorithmsModern: {
+				"curve25519-sha256", "curve25519-sha256@libssh.org",
+				"ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256",
+				"diffie-hellman-group-exchange-sha256", "diffie-hellman-group14-sha256",
+			},
+			AlgorithmsCompat: {
+				"curve25519-sha256", "curve25519-sha256@libssh.org",
+				"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+				"diffie-hellman-group-exchange-sha256", "diffie-hellman-group14-sha256",
+				"diffie-hellman-group14-sha1", "diffie-hellman-group-exchange-sha1", "diffie-hellman-group1-sha1",
+			},
+		},
+	}
+	macAlgorithms = algorithmKind{
+		name: "mac",
+		presets: map[string][]string{
+			AlgorithmsDefault: {"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"},
+			AlgorithmsModern:  {"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+			AlgorithmsCompat:  {"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"},
+		},
+	}
+	hostKeyAlgorithms = algorithmKind{
+		name: "host key",
+		presets: map[string][]string{
+			AlgorithmsDefault: {
+				ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+				ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+				ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+				ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+				ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+				ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+				ssh.KeyAlgoED25519,
+			},
+			AlgorithmsModern: {
+				ssh.CertAlgoED25519v01,
+				ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+				ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+				ssh.KeyAlgoED25519,
+				ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+				ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+			},
+			AlgorithmsCompat: {
+				ssh.CertAlgoED25519v01,
+				ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+				ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+				ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01,
+				ssh.KeyAlgoED25519,
+				ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+				ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+				ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+			},
+		},
+	}
+)
+
+// expand replaces presets by their algorithms, removes duplicates and checks that algorithms are supported,
+// nil is returned when names is empty to keep library defaults
+func (k algorithmKind) expand(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	supported := k.presets[AlgorithmsCompat]
+	result := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	add := func(algo string) {
+		if !seen[algo] {
+			seen[algo] = true
+			result = append(result, algo)
+		}
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if preset, ok := k.presets[strings.ToLower(name)]; ok {
+			for _, algo := range preset {
+				add(algo)
+			}
+			continue
+		}
+		if !containsString(supported, name) {
+			return nil, fmt.Errorf("Unknown %s algorithm %q, supported are: %s", k.name, name, strings.Join(supported, ", "))
+		}
+		add(name)
+	}
+	return result, nil
+}
+
+// sshAlgorithms are algorithms of SSHConf with presets expanded
+type sshAlgorithms struct {
+	ciphers           []string
+	keyExchanges      []string
+	macs              []string
+	hostKeyAlgorithms []string
+}
+
+func (c SSHConf) algorithms() (sshAlgorithms, error) {
+	var algos sshAlgorithms
+	var err error
+	algos.ciphers, err = cipherAlgorithms.expand(c.Ciphers)
+	if err != nil {
+		return algos, err
+	}
+	algos.keyExchanges, err = kexAlgorithms.expand(c.KeyExchanges)
+	if err != nil {
+		return algos, err
+	}
+	algos.macs, err = macAlgorithms.expand(c.MACs)
+	if err != nil {
+		return algos, err
+	}
+	algos.hostKeyAlgorithms, err = hostKeyAlgorithms.expand(c.HostKeyAlgorithms)
+	if err != nil {
+		return algos, err
+	}
+	return algos, nil
+}
+
+// restrictAlgorithms keeps known host key algorithms (e.g. from known_hosts) which are allowed,
+// allowed ones are returned if none is left
+func restrictAlgorithms(allowed, known []string) []string {
+	if len(allowed) == 0 {
+		return known
+	}
+	result := make([]string, 0, len(known))
+	for _, algo := range known {
+		if containsString(allowed, algo) {
+			result = append(result, algo)
+		}
+	}
+	if len(result) == 0 {
+		return allowed
+	}
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
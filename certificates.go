@@ -0,0 +1,123 @@
+package sshbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseUserCertificate parses an OpenSSH user certificate in authorized_keys format as found in *-cert.pub files
+func ParseUserCertificate(certBytes []byte) (*ssh.Certificate, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate: %s", err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("Failed to parse certificate: key of type %s is not a certificate", pubKey.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("Failed to parse certificate: certificate is not a user certificate")
+	}
+	return cert, nil
+}
+
+// userCertificate loads the certificate set in conf or, like OpenSSH does, the one next to the private key
+func (c SSHConf) userCertificate() (*ssh.Certificate, error) {
+	certBytes := c.CertificateBytes
+	if len(certBytes) == 0 && c.Certificate != "" {
+		var err error
+		certBytes, err = os.ReadFile(expandHome(c.Certificate))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(certBytes) == 0 {
+		if c.PrivateKey == "" {
+			return nil, nil
+		}
+		return identityCertificate(c.PrivateKey)
+	}
+	return loadUserCertificate(certBytes)
+}
+
+// identityCertificate loads <path>-cert.pub if it exists
+func identityCertificate(path string) (*ssh.Certificate, error) {
+	certBytes, err := os.ReadFile(expandHome(path) + "-cert.pub")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadUserCertificate(certBytes)
+}
+
+// loadUserCertificate parses a user certificate and warns when it has expired
+func loadUserCertificate(certBytes []byte) (*ssh.Certificate, error) {
+	cert, err := ParseUserCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := uint64(time.Now().Unix())
+	if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+		logger.Warningf("Certificate %s has expired", cert.KeyId)
+	}
+	return cert, nil
+}
+
+// warnUnusedCertificate warns when certificate key is neither an identity nor an agent key as certificate is ignored then
+func warnUnusedCertificate(cert *ssh.Certificate, identitySigners []ssh.Signer, agentSigners func() ([]ssh.Signer, error)) {
+	if cert == nil || certKeyIn(cert, identitySigners) {
+		return
+	}
+	if agentSigners != nil {
+		signers, err := agentSigners()
+		if err == nil && certKeyIn(cert, signers) {
+			return
+		}
+	}
+	logger.Warningf("Certificate %s is ignored, its key is neither an identity nor an agent key", cert.KeyId)
+}
+
+func certKeyIn(cert *ssh.Certificate, signers []ssh.Signer) bool {
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCertSigners puts a certificate signer before each signer matching certificate key
+func withCertSigners(cert *ssh.Certificate, signers []ssh.Signer) ([]ssh.Signer, error) {
+	if cert == nil {
+		return signers, nil
+	}
+	result := make([]ssh.Signer, 0, len(signers)+1)
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, certSigner)
+		}
+		result = append(result, signer)
+	}
+	return result, nil
+}
+
+func certSignersCallback(cert *ssh.Certificate, getSigners func() ([]ssh.Signer, error)) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		signers, err := getSigners()
+		if err != nil {
+			return nil, err
+		}
+		return withCertSigners(cert, signers)
+	}
+}
@@ -33,11 +33,11 @@ func NewCommanderSSH(sshBox *SSHBox) *CommanderSSH {
 }
 
 func (c *CommanderSSH) Run(cmd string, opts ...SSHSessionOptions) (stdout []byte, stderr []byte, err error) {
-	sess, err := MakeSessionNoTerminal(c.sshBox.SSHClient(), opts...)
+	sess, err := MakeSessionNoTerminal(c.sshBox.SSHClient(), c.sshBox.sessionOptions(opts)...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to make sessions: %s", err)
 	}
-	defer sess.Close()
+	defer c.sshBox.CloseSession(sess)
 	stdoutBuffer := &bytes.Buffer{}
 	stderrBuffer := &bytes.Buffer{}
 	sess.Stdout = stdoutBuffer
@@ -50,14 +50,27 @@ func (c *CommanderSSH) Run(cmd string, opts ...SSHSessionOptions) (stdout []byte
 }
 
 func (c *CommanderSSH) CombinedOutput(cmd string, opts ...SSHSessionOptions) ([]byte, error) {
-	sess, err := MakeSessionNoTerminal(c.sshBox.SSHClient(), opts...)
+	sess, err := MakeSessionNoTerminal(c.sshBox.SSHClient(), c.sshBox.sessionOptions(opts)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make sessions: %s", err)
 	}
-	defer sess.Close()
+	defer c.sshBox.CloseSession(sess)
 	return sess.CombinedOutput(cmd)
 }
 
+// NewSession creates a commander session on box client with session options enabled in box conf applied,
+// e.g. ForwardAgent and ForwardX11, before the ones given with WithSessionOptions
+func (c *CommanderSSH) NewSession(opts ...commanderSessionOptions) (*CommanderSession, error) {
+	boxOpts := make([]commanderSessionOptions, 0, len(opts)+1)
+	boxOpts = append(boxOpts, opts...)
+	boxOpts = append(boxOpts, func(cmderSess *CommanderSession) error {
+		cmderSess.sessOpts = c.sshBox.sessionOptions(cmderSess.sessOpts)
+		cmderSess.sshBox = c.sshBox
+		return nil
+	})
+	return NewCommanderSession(c.sshBox.SSHClient(), boxOpts...)
+}
+
 func DefaultPromptMatcher(line []byte) bool {
 	return strings.Contains(string(line), "$ ")
 }
@@ -73,6 +86,7 @@ func DefaultSanitizePromptLine(line []byte) []byte {
 // CommanderSession let you run multiple commands on a remote host and getting the output back on a single session
 // which means that context is persisted between commands but output is buffered and split by a promptMatcher which is often the prompt
 type CommanderSession struct {
+	sshBox             *SSHBox
 	session            *ssh.Session
 	promptMatcher      func(line []byte) bool
 	sanitizePromptLine func(line []byte) []byte
@@ -133,7 +147,8 @@ func WithSanitizePromptLine(sanitizePromptLine func(line []byte) []byte) command
 	}
 }
 
-// NewCommanderSession creates a new commander session
+// NewCommanderSession creates a new commander session, options of box conf like ForwardAgent are not applied on a raw client,
+// use CommanderSSH.NewSession or WithSessionOptions(box.SessionAgentForwarding()) for them
 func NewCommanderSession(client *ssh.Client, opts ...commanderSessionOptions) (*CommanderSession, error) {
 	cmderSess := &CommanderSession{}
 	for _, opt := range opts {
@@ -261,5 +276,8 @@ func (c *CommanderSession) dropCR(data []byte) []byte {
 }
 
 func (c *CommanderSession) Close() error {
+	if c.sshBox != nil {
+		return c.sshBox.CloseSession(c.session)
+	}
 	return c.session.Close()
 }
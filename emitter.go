@@ -76,6 +76,38 @@ func (em *Emitter) ListenersStopSocks() []<-chan emitter.Event {
 	return em.e.Listeners("sshbox_stop_socks")
 }
 
+func (em *Emitter) EmitStopHttpProxy() {
+	em.e.Emit("sshbox_stop_http_proxy", fmt.Errorf(""))
+}
+
+func (em *Emitter) OnStopHttpProxy() <-chan emitter.Event {
+	return em.e.On("sshbox_stop_http_proxy", emitter.Sync)
+}
+
+func (em *Emitter) OffStopHttpProxy(events ...<-chan emitter.Event) {
+	em.e.Off("sshbox_stop_http_proxy", events...)
+}
+
+func (em *Emitter) ListenersStopHttpProxy() []<-chan emitter.Event {
+	return em.e.Listeners("sshbox_stop_http_proxy")
+}
+
+func (em *Emitter) EmitStopPac() {
+	em.e.Emit("sshbox_stop_pac", fmt.Errorf(""))
+}
+
+func (em *Emitter) OnStopPac() <-chan emitter.Event {
+	return em.e.On("sshbox_stop_pac", emitter.Sync)
+}
+
+func (em *Emitter) OffStopPac(events ...<-chan emitter.Event) {
+	em.e.Off("sshbox_stop_pac", events...)
+}
+
+func (em *Emitter) ListenersStopPac() []<-chan emitter.Event {
+	return em.e.Listeners("sshbox_stop_pac")
+}
+
 func (em *Emitter) emitStartTunnels() {
 	em.e.Emit("sshbox_start_tunnels", fmt.Errorf(""))
 }
@@ -92,6 +124,22 @@ func (em *Emitter) ListenersStartTunnels() []<-chan emitter.Event {
 	return em.e.Listeners("sshbox_start_tunnels")
 }
 
+func (em *Emitter) emitReconnected() {
+	em.e.Emit("sshbox_reconnected", fmt.Errorf(""))
+}
+
+func (em *Emitter) OnReconnected() <-chan emitter.Event {
+	return em.e.On("sshbox_reconnected", emitter.Sync)
+}
+
+func (em *Emitter) OffReconnected(events ...<-chan emitter.Event) {
+	em.e.Off("sshbox_reconnected", events...)
+}
+
+func (em *Emitter) ListenersReconnected() []<-chan emitter.Event {
+	return em.e.Listeners("sshbox_reconnected")
+}
+
 func (em *Emitter) ToError(evt emitter.Event) error {
 	if len(evt.Args) == 0 {
 		return nil
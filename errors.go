@@ -35,3 +35,50 @@ func IsTerminalError(err error) (*TerminalError, bool) {
 	}
 	return nil, false
 }
+
+type HostKeyErrorReason int
+
+const (
+	HostKeyUnknown HostKeyErrorReason = iota
+	HostKeyChanged
+	HostKeyRevoked
+	HostKeyInvalidCertificate
+)
+
+// HostKeyError is returned when the host key of the server is refused by known_hosts verification
+type HostKeyError struct {
+	Hostname    string
+	Fingerprint string
+	Reason      HostKeyErrorReason
+	// Known holds the known_hosts locations of the keys expected for this host
+	Known []string
+	// Cause is the reason an host certificate was refused
+	Cause error
+}
+
+func (e HostKeyError) Error() string {
+	switch e.Reason {
+	case HostKeyChanged:
+		return fmt.Sprintf(
+			"Host key verification failed: host key for %s has changed, received key with fingerprint SHA256:%s, expected keys are at %s",
+			e.Hostname, e.Fingerprint, strings.Join(e.Known, ", "),
+		)
+	case HostKeyInvalidCertificate:
+		return fmt.Sprintf("Host key verification failed: invalid host certificate SHA256:%s for %s: %s", e.Fingerprint, e.Hostname, e.Cause)
+	case HostKeyRevoked:
+		msg := fmt.Sprintf("Host key verification failed: host key SHA256:%s for %s is revoked", e.Fingerprint, e.Hostname)
+		if len(e.Known) > 0 {
+			msg += " at " + strings.Join(e.Known, ", ")
+		}
+		return msg
+	default:
+		return fmt.Sprintf("Host key verification failed: no host key is known for %s, received key with fingerprint SHA256:%s", e.Hostname, e.Fingerprint)
+	}
+}
+
+func IsHostKeyError(err error) (*HostKeyError, bool) {
+	if errHostKey, ok := err.(*HostKeyError); ok {
+		return errHostKey, true
+	}
+	return nil, false
+}
@@ -1,13 +1,14 @@
 package sshbox
 
 import (
-	"fmt"
+	"context"
 	"net"
 	"strconv"
-
-	"github.com/phayes/freeport"
 )
 
+// GatewayInfo describes a local port forwarded to the next hop of gateways.
+//
+// Deprecated: gateways are chained over ssh channels, see Gateways.Chain
 type GatewayInfo struct {
 	SrcSSHUri  string
 	LocalPort  int
@@ -24,87 +25,54 @@ func NewGateways(gateways []*SSHConf) *Gateways {
 	return &Gateways{gateways: gateways, gwBoxes: make([]*SSHBox, 0)}
 }
 
+// RunGateways connects through gateways and forwards a local port to toHost from the last gateway,
+// it returns the local address to connect to, or toHost when there is no gateway.
+//
+// Deprecated: use Chain which gives a factory making ssh clients through gateways without opening a local port
 func (g *Gateways) RunGateways(toHost string) (string, error) {
 	if len(g.gateways) == 0 {
 		return toHost, nil
 	}
-	sshUris := make([]GatewayInfo, len(g.gateways))
-	for i, gateway := range g.gateways {
-		gi := GatewayInfo{}
-		port, err := freeport.GetFreePort()
-		if err != nil {
-			return "", err
-		}
-		gi.LocalPort = port
-		if i == 0 {
-			gi.SrcSSHUri = gateway.Host
-		} else {
-			gi.SrcSSHUri = fmt.Sprintf("127.0.0.1:%d", sshUris[i-1].LocalPort)
-		}
-		if len(g.gateways) == i+1 {
-			sshUris[i] = gi
-			continue
-		}
-		remoteHost, remotePortRaw, err := net.SplitHostPort(g.gateways[i+1].Host)
-		if err != nil {
-			return "", err
-		}
-		gi.RemoteHost = remoteHost
-		gi.RemotePort, _ = strconv.Atoi(remotePortRaw)
-		sshUris[i] = gi
+	_, err := g.Chain(context.Background())
+	if err != nil {
+		return "", err
 	}
+	remoteHost, remotePortRaw, err := net.SplitHostPort(toHost)
+	if err != nil {
+		g.Close()
+		return "", err
+	}
+	remotePort, _ := strconv.Atoi(remotePortRaw)
+	tunnel, err := g.gwBoxes[len(g.gwBoxes)-1].AddTunnel(&TunnelTarget{
+		RemoteHost: remoteHost,
+		RemotePort: remotePort,
+	})
+	if err != nil {
+		g.Close()
+		return "", err
+	}
+	return tunnel.Addr().String(), nil
+}
 
-	for i, gateway := range g.gateways {
-		sb, err := NewSSHBox(SSHConf{
-			Host:               sshUris[i].SrcSSHUri,
-			User:               gateway.User,
-			Password:           gateway.Password,
-			PrivateKey:         gateway.PrivateKey,
-			Passphrase:         gateway.Passphrase,
-			HostKeyFingerprint: gateway.HostKeyFingerprint,
-			SSHAuthSock:        gateway.SSHAuthSock,
-		})
-		if err != nil {
-			return "", err
-		}
-		sub := sb.emitter.OnStartTunnels()
-		var target *TunnelTarget
-		if i == len(g.gateways)-1 {
-			remoteHost, remotePortRaw, err := net.SplitHostPort(toHost)
-			if err != nil {
-				return "", err
-			}
-			remotePort, _ := strconv.Atoi(remotePortRaw)
-			target = &TunnelTarget{
-				RemoteHost: remoteHost,
-				RemotePort: remotePort,
-				LocalPort:  sshUris[i].LocalPort,
-			}
-		} else {
-			target = &TunnelTarget{
-				RemoteHost: sshUris[i].RemoteHost,
-				RemotePort: sshUris[i].RemotePort,
-				LocalPort:  sshUris[i].LocalPort,
-			}
-		}
-		err = target.CheckAndFill()
+// Chain connects to each gateway through the previous one, no local port is opened, connecting is aborted when ctx is done.
+// It returns a factory making ssh clients through the last gateway, or the default factory when there is no gateway.
+func (g *Gateways) Chain(ctx context.Context) (SshClientFactoryContext, error) {
+	var factory SshClientFactoryContext = DefaultSshClientFactoryContext
+	for _, gateway := range g.gateways {
+		sb, err := NewSSHBoxContext(ctx, *gateway, OptSSHClientFactoryContext(factory))
 		if err != nil {
-			return "", err
+			g.Close()
+			return nil, err
 		}
-		go func() {
-			err := sb.StartTunnels([]*TunnelTarget{target})
-			if err != nil {
-				logger.Errorf("Could not start tunnel for gateways: %s", err.Error())
-			}
-		}()
-		<-sub
 		g.gwBoxes = append(g.gwBoxes, sb)
+		factory = SshClientFactoryFromDialer(sb.DialContext)
 	}
-	return fmt.Sprintf("127.0.0.1:%d", sshUris[len(sshUris)-1].LocalPort), nil
+	return factory, nil
 }
 
 func (g *Gateways) Close() {
 	for i := len(g.gwBoxes) - 1; i >= 0; i-- {
 		g.gwBoxes[i].Close()
 	}
+	g.gwBoxes = make([]*SSHBox, 0)
 }
@@ -0,0 +1,147 @@
+package sshbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// makeHostKeyCallback builds host key verification from conf and returns host key algorithms to request, if any.
+// Error raised by verification is stored in hostKeyErr as ssh handshake does not keep error type.
+func makeHostKeyCallback(conf SSHConf, hostKeyErr *error) (ssh.HostKeyCallback, []string, error) {
+	hostKeyCheck, knownHostsFiles, err := conf.knownHosts()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostCAs, err := parsePublicKeys(conf.HostCAKeys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse host CA keys: %s", err)
+	}
+	revokedKeys, err := parsePublicKeys(conf.RevokedHostKeys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to parse revoked host keys: %s", err)
+	}
+
+	var hostKeyAlgorithms []string
+	var rawKnownHosts ssh.HostKeyCallback
+	var callback ssh.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	switch {
+	case conf.HostKeyFingerprint != "":
+		callback = fingerprintCallback(conf.HostKeyFingerprint)
+	case hostKeyCheck != "" && hostKeyCheck != HostKeyCheckOff:
+		rawKnownHosts, err = loadKnownHosts(knownHostsFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+		callback = knownHostsCallback(rawKnownHosts, knownHostsFiles, hostKeyCheck, hostKeyErr)
+		if len(hostCAs) == 0 {
+			hostKeyAlgorithms = knownHostKeyAlgorithms(rawKnownHosts, conf.hostKeyHostname())
+		}
+	case len(hostCAs) > 0 && hostKeyCheck != HostKeyCheckOff:
+		// trusting a CA means host keys must be verified, hosts without certificate are unknown
+		callback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return storeHostKeyErr(hostKeyErr, &HostKeyError{
+				Hostname:    hostname,
+				Fingerprint: base64Sha256Fingerprint(key),
+				Reason:      HostKeyUnknown,
+			})
+		}
+	}
+	if len(hostCAs) > 0 || len(revokedKeys) > 0 {
+		callback = hostCertCallback(hostCAs, revokedKeys, rawKnownHosts, callback, hostKeyErr)
+	}
+	if conf.HostKeyAlias != "" {
+		callback = aliasHostKeyCallback(conf.hostKeyHostname(), callback)
+	}
+	return callback, hostKeyAlgorithms, nil
+}
+
+// aliasHostKeyCallback verifies host key as if it was presented by the alias hostname
+func aliasHostKeyCallback(alias string, callback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return callback(alias, remote, key)
+	}
+}
+
+// hostCertCallback verifies certificates signed by one of the host CAs given, checking principals, validity
+// and revocation. Other keys and certificates are verified by fallback.
+func hostCertCallback(hostCAs, revokedKeys []ssh.PublicKey, knownHosts, fallback ssh.HostKeyCallback, hostKeyErr *error) ssh.HostKeyCallback {
+	isRevoked := func(hostname string, remote net.Addr, key ssh.PublicKey) bool {
+		if containsKey(revokedKeys, key) {
+			return true
+		}
+		if knownHosts == nil {
+			return false
+		}
+		var revokedErr *knownhosts.RevokedError
+		return errors.As(knownHosts(hostname, remote, key), &revokedErr)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, isCert := key.(*ssh.Certificate)
+		if !isCert {
+			if containsKey(revokedKeys, key) {
+				return storeHostKeyErr(hostKeyErr, &HostKeyError{
+					Hostname:    hostname,
+					Fingerprint: base64Sha256Fingerprint(key),
+					Reason:      HostKeyRevoked,
+				})
+			}
+			return fallback(hostname, remote, key)
+		}
+		if !containsKey(hostCAs, cert.SignatureKey) {
+			return fallback(hostname, remote, key)
+		}
+		if isRevoked(hostname, remote, cert.Key) || isRevoked(hostname, remote, cert.SignatureKey) {
+			return storeHostKeyErr(hostKeyErr, &HostKeyError{
+				Hostname:    hostname,
+				Fingerprint: base64Sha256Fingerprint(key),
+				Reason:      HostKeyRevoked,
+			})
+		}
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+				return containsKey(hostCAs, auth)
+			},
+		}
+		err := checker.CheckHostKey(hostname, remote, key)
+		if err != nil {
+			return storeHostKeyErr(hostKeyErr, &HostKeyError{
+				Hostname:    hostname,
+				Fingerprint: base64Sha256Fingerprint(key),
+				Reason:      HostKeyInvalidCertificate,
+				Cause:       err,
+			})
+		}
+		return nil
+	}
+}
+
+func storeHostKeyErr(hostKeyErr *error, err *HostKeyError) error {
+	*hostKeyErr = err
+	return err
+}
+
+func parsePublicKeys(authorizedKeys []string) ([]ssh.PublicKey, error) {
+	keys := make([]ssh.PublicKey, len(authorizedKeys))
+	for i, authorizedKey := range authorizedKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package sshbox
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ArthurHlt/go-socks5"
+	"github.com/sirupsen/logrus"
+)
+
+// hopHeaders are removed from requests and responses going through http proxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// StartHTTPProxyServer serves an http proxy on local port, supporting CONNECT method and plain http requests
+// with absolute uri, names are resolved with the same NameResolver as socks server and connections are dialed
+// through ssh server. Clients must authenticate when OptHTTPProxyCredentials is set. It blocks until http proxy is stopped.
+func (t *SSHBox) StartHTTPProxyServer(port int) error {
+	nameResolver, err := t.nameResolver()
+	if err != nil {
+		return err
+	}
+	proxy := newHTTPProxy(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return t.dialResolved(ctx, nameResolver, network, addr)
+	}, t.httpProxyCredentials, t.config.connectTimeout())
+	entry := logger.WithField("target", t.config)
+	entry.Debugf("Starting listening http proxy server on port %d", port)
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	t.setProxyAddr(&t.httpProxyAddr, listener.Addr())
+	defer t.setProxyAddr(&t.httpProxyAddr, nil)
+	return proxy.serve(listener, t.emitter, entry)
+}
+
+func (t *SSHBox) StopHTTPProxyServer() {
+	t.emitter.EmitStopHttpProxy()
+}
+
+type httpProxy struct {
+	dial           Dialer
+	credentials    socks5.CredentialStore
+	connectTimeout time.Duration
+	transport      *http.Transport
+}
+
+func newHTTPProxy(dial Dialer, credentials socks5.CredentialStore, connectTimeout time.Duration) *httpProxy {
+	return &httpProxy{
+		dial:           dial,
+		credentials:    credentials,
+		connectTimeout: connectTimeout,
+		transport: &http.Transport{
+			DialContext: dial,
+		},
+	}
+}
+
+// serve serves proxy on listener until stop http proxy is emitted
+func (p *httpProxy) serve(listener net.Listener, em *Emitter, entry *logrus.Entry) error {
+	defer p.transport.CloseIdleConnections()
+	server := &http.Server{Handler: p}
+	stopHttpProxy := em.OnStopHttpProxy()
+	defer em.OffStopHttpProxy(stopHttpProxy)
+	go func() {
+		<-stopHttpProxy
+		entry.Debug("Stopping http proxy cause of emitted stop http proxy message")
+		server.Close()
+	}()
+	err := server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !p.authenticate(req) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="sshbox"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if req.Method == http.MethodConnect {
+		p.handleConnect(w, req)
+		return
+	}
+	if !req.URL.IsAbs() {
+		http.Error(w, "This is a proxy server, requests must have an absolute uri", http.StatusBadRequest)
+		return
+	}
+	p.handleRequest(w, req)
+}
+
+func (p *httpProxy) authenticate(req *http.Request) bool {
+	if p.credentials == nil {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && p.credentials.Valid(user, password)
+}
+
+func (p *httpProxy) handleConnect(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), p.connectTimeout)
+	defer cancel()
+	// CONNECT is meant for https, a host without port is on 443
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "443")
+	}
+	remoteConn, err := p.dial(ctx, "tcp", addr)
+	if err != nil {
+		logger.Debugf("http proxy connect to %s failed: %s", addr, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remoteConn.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		logger.Debugf("http proxy hijack failed: %s", err)
+		return
+	}
+	defer client.Close()
+	_, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+	if buf.Reader.Buffered() > 0 {
+		client = &bufferedConn{Conn: client, reader: buf.Reader}
+	}
+	copyData(client, remoteConn)
+}
+
+func (p *httpProxy) handleRequest(w http.ResponseWriter, req *http.Request) {
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		logger.Debugf("http proxy request to %s failed: %s", req.URL.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		logger.Debugf("error while copy http proxy response: %s", err.Error())
+	}
+}
+
+// dialResolved resolves host of addr with nameResolver, or leaves it to ssh server when nil, and dials through ssh server
+func (t *SSHBox) dialResolved(ctx context.Context, nameResolver NameResolver, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "80"
+	}
+	if nameResolver != nil && net.ParseIP(host) == nil {
+		_, ip, err := nameResolver.Resolve(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve %s: %s", host, err)
+		}
+		host = ip.String()
+	}
+	return t.DialContext(ctx, network, net.JoinHostPort(host, port))
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,160 @@
+package sshbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ArthurHlt/go-socks5"
+)
+
+func TestHTTPProxyConnectDefaultPort(t *testing.T) {
+	dialed := make(chan string, 1)
+	proxy := newHTTPProxy(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return nil, fmt.Errorf("no route")
+	}, nil, time.Second)
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	tests := []struct {
+		host string
+		addr string
+	}{
+		{host: "example.com", addr: "example.com:443"},
+		{host: "example.com:8443", addr: "example.com:8443"},
+		{host: "[::1]", addr: "[::1]:443"},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", test.host, test.host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("CONNECT %s: %s", test.host, err)
+		}
+		resp.Body.Close()
+		if addr := <-dialed; addr != test.addr {
+			t.Errorf("CONNECT %s: expected to dial %s, got %s", test.host, test.addr, addr)
+		}
+	}
+}
+
+func newTestHTTPProxyBox(t *testing.T, opts ...SSHBoxOptions) (*SSHBox, *testSSHServer) {
+	t.Helper()
+	server := newTestSSHServer(t)
+	box, err := NewSSHBox(server.conf(), opts...)
+	if err != nil {
+		t.Fatalf("NewSSHBox: %s", err)
+	}
+	t.Cleanup(box.Close)
+	box.SetNameResolverFactory(func(sshBox *SSHBox) (NameResolver, error) {
+		return nil, nil
+	})
+	return box, server
+}
+
+// newTestHTTPBackend answers "hello" and sends received requests to returned channel
+func newTestHTTPBackend(t *testing.T) (*httptest.Server, <-chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- req
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("hello"))
+	}))
+	t.Cleanup(backend.Close)
+	return backend, requests
+}
+
+func testProxyClient(proxyURL string) *http.Client {
+	parsed, _ := url.Parse(proxyURL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(parsed)}, Timeout: 5 * time.Second}
+}
+
+func TestHTTPProxyRequest(t *testing.T) {
+	box, server := newTestHTTPProxyBox(t)
+	backend, requests := newTestHTTPBackend(t)
+	proxyAddr := startTestHTTPProxyServer(t, box, nil)
+
+	req, err := http.NewRequest(http.MethodGet, backend.URL+"/path?query=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "dropped")
+	req.Header.Set("X-Kept", "kept")
+	resp, err := testProxyClient("http://" + proxyAddr).Do(req)
+	if err != nil {
+		t.Fatalf("request through http proxy: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("expected backend response, got %d %q", resp.StatusCode, body)
+	}
+	received := <-requests
+	if received.URL.RequestURI() != "/path?query=1" || received.Header.Get("X-Kept") != "kept" || received.Header.Get("X-Hop") != "" {
+		t.Errorf("unexpected request forwarded to backend: %s %v", received.URL, received.Header)
+	}
+	if dials := server.directDials(); len(dials) != 1 || dials[0] != backend.Listener.Addr().String() {
+		t.Errorf("expected backend to be dialed through ssh, got %v", dials)
+	}
+}
+
+func TestHTTPProxyBasicAuth(t *testing.T) {
+	box, _ := newTestHTTPProxyBox(t, OptHTTPProxyCredentials(socks5.StaticCredentials{"alice": "secret"}))
+	backend, requests := newTestHTTPBackend(t)
+	proxyAddr := startTestHTTPProxyServer(t, box, nil)
+
+	for _, proxyURL := range []string{"http://" + proxyAddr, "http://alice:wrong@" + proxyAddr} {
+		resp, err := testProxyClient(proxyURL).Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("expected %s to be asked for proxy authentication, got %d", proxyURL, resp.StatusCode)
+		}
+	}
+	if len(requests) != 0 {
+		t.Errorf("expected unauthenticated requests not to reach backend")
+	}
+
+	resp, err := testProxyClient("http://alice:secret@" + proxyAddr).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected authenticated request to succeed, got %d", resp.StatusCode)
+	}
+	if received := <-requests; received.Header.Get("Proxy-Authorization") != "" {
+		t.Errorf("expected proxy credentials not to be forwarded to backend")
+	}
+}
+
+func TestHTTPProxyStopUnsubscribes(t *testing.T) {
+	box, _ := newTestHTTPProxyBox(t)
+	for i := 0; i < 3; i++ {
+		done := make(chan error, 1)
+		startTestHTTPProxyServer(t, box, done)
+		err := stopTestServer(box.StopHTTPProxyServer, done)
+		if err != nil {
+			t.Fatalf("http proxy server: %s", err)
+		}
+	}
+	if listeners := box.emitter.ListenersStopHttpProxy(); len(listeners) != 0 {
+		t.Errorf("expected stopped http proxy servers to unsubscribe, got %d listeners", len(listeners))
+	}
+}
@@ -0,0 +1,116 @@
+package sshbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Identity is a private key used for public key authentication, one of Path, PEMBytes or Signer must be set
+type Identity struct {
+	// Path is a private key file, <Path>-cert.pub certificate is used when it exists
+	Path string
+	// PEMBytes is a private key content in PEM or OpenSSH format
+	PEMBytes []byte
+	Signer   ssh.Signer
+	// Passphrase decrypts an encrypted key, SSHConf.PassphraseCallback is used when it is empty
+	Passphrase string
+}
+
+func (i Identity) String() string {
+	switch {
+	case i.Path != "":
+		return i.Path
+	case i.Signer != nil:
+		return fmt.Sprintf("%s key %s", i.Signer.PublicKey().Type(), base64Sha256Fingerprint(i.Signer.PublicKey()))
+	default:
+		return "private key from memory"
+	}
+}
+
+// identities returns PrivateKey followed by Identities
+func (c SSHConf) identities() []Identity {
+	identities := make([]Identity, 0, len(c.Identities)+1)
+	if c.PrivateKey != "" {
+		identities = append(identities, Identity{Path: c.PrivateKey, Passphrase: c.Passphrase})
+	}
+	return append(identities, c.Identities...)
+}
+
+// identitySigners loads signers of all identities in order, certificates found next to identity files come before their key.
+// Like OpenSSH, an identity which fails to load is skipped with a warning, except PrivateKey which was explicitly asked for.
+// Signers already loaded by SSHBox are returned as is.
+func (c SSHConf) identitySigners() ([]ssh.Signer, error) {
+	if c.loadedSigners != nil {
+		return c.loadedSigners, nil
+	}
+	signers := make([]ssh.Signer, 0)
+	for i, identity := range c.identities() {
+		signer, err := c.identitySigner(identity)
+		if err != nil && i == 0 && c.PrivateKey != "" {
+			return nil, fmt.Errorf("Failed to load private key %s: %s", identity, err)
+		}
+		if err != nil {
+			logger.Warningf("Skipping identity %s, failed to load it: %s", identity, err)
+			continue
+		}
+		// certificate next to PrivateKey is loaded by userCertificate
+		if identity.Path != "" && (i > 0 || c.PrivateKey == "") {
+			cert, err := identityCertificate(identity.Path)
+			if cert != nil {
+				var certSigner ssh.Signer
+				certSigner, err = ssh.NewCertSigner(cert, signer)
+				if err == nil {
+					signers = append(signers, certSigner)
+				}
+			}
+			if err != nil {
+				logger.Warningf("Skipping certificate of identity %s: %s", identity, err)
+			}
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func (c SSHConf) identitySigner(identity Identity) (ssh.Signer, error) {
+	if identity.Signer != nil {
+		return identity.Signer, nil
+	}
+	key, err := c.identityKey(identity)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// identityKey parses raw private key of an identity from PEMBytes or Path,
+// asking passphrase to callback if key is encrypted and has none
+func (c SSHConf) identityKey(identity Identity) (interface{}, error) {
+	pemBytes := identity.PEMBytes
+	if len(pemBytes) == 0 {
+		if identity.Path == "" {
+			return nil, fmt.Errorf("one of Path, PEMBytes or Signer must be set")
+		}
+		var err error
+		pemBytes, err = os.ReadFile(expandHome(identity.Path))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if identity.Passphrase != "" {
+		return ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(identity.Passphrase))
+	}
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) || c.PassphraseCallback == nil {
+		return key, err
+	}
+	passphrase, err := c.PassphraseCallback(identity)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+}
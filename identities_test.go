@@ -0,0 +1,104 @@
+package sshbox
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestEncryptedKey writes an ecdsa private key encrypted with passphrase in a legacy PEM file
+func writeTestEncryptedKey(t *testing.T, passphrase string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// legacy PEM encryption is deprecated but still parsed by ssh package
+	block, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte(passphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+	err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIdentitySignersSkipsFailingIdentities(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := SSHConf{
+		Identities: []Identity{
+			{Path: filepath.Join(t.TempDir(), "missing")},
+			{PEMBytes: []byte("not a key")},
+			{Signer: signer},
+		},
+	}
+	signers, err := conf.identitySigners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || string(signers[0].PublicKey().Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Fatalf("expected only the loadable identity, got %d signers", len(signers))
+	}
+}
+
+func TestIdentitySignersPrivateKeyError(t *testing.T) {
+	conf := SSHConf{PrivateKey: filepath.Join(t.TempDir(), "missing")}
+	_, err := conf.identitySigners()
+	if err == nil {
+		t.Errorf("expected an error for a private key which can't be loaded")
+	}
+
+	conf = SSHConf{PrivateKey: writeTestEncryptedKey(t, "right"), Passphrase: "wrong"}
+	_, err = conf.identitySigners()
+	if err == nil {
+		t.Errorf("expected an error for a private key with a wrong passphrase")
+	}
+}
+
+func TestIdentitySignersLoadedOnce(t *testing.T) {
+	server := newTestSSHServer(t)
+	conf := server.conf()
+	conf.PrivateKey = writeTestEncryptedKey(t, "secret")
+	asked := 0
+	conf.PassphraseCallback = func(identity Identity) (string, error) {
+		asked++
+		return "secret", nil
+	}
+	box, err := NewSSHBox(conf)
+	if err != nil {
+		t.Fatalf("NewSSHBox: %s", err)
+	}
+	defer box.Close()
+
+	client, err := box.makeSSHClient(context.Background())
+	if err != nil {
+		t.Fatalf("reconnect: %s", err)
+	}
+	client.Close()
+	if asked != 1 {
+		t.Errorf("expected passphrase to be asked once, asked %d times", asked)
+	}
+}
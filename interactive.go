@@ -42,9 +42,9 @@ func (c *InteractiveSSH) startInteractive(commands []string, subSystem string, t
 	if err != nil {
 		return fmt.Errorf("SSH session allocation failed: %s", err.Error())
 	}
-	defer c.session.Close()
+	defer c.sshBox.CloseSession(c.session)
 
-	for _, opt := range sessOpts {
+	for _, opt := range c.sshBox.sessionOptions(sessOpts) {
 		err := opt(c.session)
 		if err != nil {
 			return fmt.Errorf("SSH session option failed: %s", err.Error())
@@ -0,0 +1,138 @@
+package sshbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	passwordQuestionRE = regexp.MustCompile(`(?i)pass(word|phrase)`)
+	totpQuestionRE     = regexp.MustCompile(`(?i)(verification|one[- ]time|otp|token|2fa|mfa|authenticator|code)`)
+	// oneTimeQuestionRE matches questions like "One-time password:" which must not be answered with password
+	oneTimeQuestionRE = regexp.MustCompile(`(?i)(one[- ]time|otp|2fa|mfa|verification)`)
+)
+
+// Challenge is a question asked by the server during keyboard-interactive authentication
+type Challenge struct {
+	User        string
+	Name        string
+	Instruction string
+	Question    string
+	Echo        bool
+}
+
+// ChallengeHandler answers a keyboard-interactive question, it returns false when it can't answer it
+type ChallengeHandler func(conf SSHConf, challenge Challenge) (answer string, ok bool, err error)
+
+// ChallengePassword answers password questions with SSHConf.Password
+func ChallengePassword(conf SSHConf, challenge Challenge) (string, bool, error) {
+	if conf.Password == "" || !passwordQuestionRE.MatchString(challenge.Question) || oneTimeQuestionRE.MatchString(challenge.Question) {
+		return "", false, nil
+	}
+	return conf.Password, true, nil
+}
+
+// ChallengeTOTP answers one-time code questions with a TOTP code generated from SSHConf.TOTPSecret
+func ChallengeTOTP(conf SSHConf, challenge Challenge) (string, bool, error) {
+	if conf.TOTPSecret == "" || !totpQuestionRE.MatchString(challenge.Question) {
+		return "", false, nil
+	}
+	code, err := GenerateTOTP(conf.TOTPSecret, time.Now())
+	if err != nil {
+		return "", false, err
+	}
+	return code, true, nil
+}
+
+// ChallengeAnswer answers questions matching questionRE with answer
+func ChallengeAnswer(questionRE *regexp.Regexp, answer string) ChallengeHandler {
+	return func(conf SSHConf, challenge Challenge) (string, bool, error) {
+		if !questionRE.MatchString(challenge.Question) {
+			return "", false, nil
+		}
+		return answer, true, nil
+	}
+}
+
+// ChallengePrompt asks every question to prompt, e.g. to ask user on a terminal
+func ChallengePrompt(prompt func(challenge Challenge) (string, error)) ChallengeHandler {
+	return func(conf SSHConf, challenge Challenge) (string, bool, error) {
+		answer, err := prompt(challenge)
+		if err != nil {
+			return "", false, err
+		}
+		return answer, true, nil
+	}
+}
+
+// GenerateTOTP generates a 6 digits RFC 6238 code (HMAC-SHA1, 30 seconds step) from a base32 secret
+func GenerateTOTP(secret string, at time.Time) (string, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid totp secret: %s", err)
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// challengeHandlers returns handlers set in conf or built-in ones for totp and password,
+// totp comes first as one-time code questions often mention a password
+func (c SSHConf) challengeHandlers() []ChallengeHandler {
+	if len(c.ChallengeHandlers) > 0 {
+		return c.ChallengeHandlers
+	}
+	handlers := make([]ChallengeHandler, 0)
+	if c.TOTPSecret != "" {
+		handlers = append(handlers, ChallengeTOTP)
+	}
+	if c.Password != "" {
+		handlers = append(handlers, ChallengePassword)
+	}
+	return handlers
+}
+
+func keyboardInteractive(conf SSHConf, handlers []ChallengeHandler) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			challenge := Challenge{
+				User:        conf.User,
+				Name:        name,
+				Instruction: instruction,
+				Question:    question,
+				Echo:        echos[i],
+			}
+			answered := false
+			for _, handler := range handlers {
+				answer, ok, err := handler(conf, challenge)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					answers[i] = answer
+					answered = true
+					break
+				}
+			}
+			if !answered {
+				return nil, fmt.Errorf("no answer for keyboard-interactive question %q", question)
+			}
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,74 @@
+package sshbox
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the base32 encoding of the RFC 6238 SHA1 test key "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerateTOTP(t *testing.T) {
+	// RFC 6238 appendix B vectors for SHA1, truncated to 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+		{unix: 20000000000, code: "353130"},
+	}
+	for _, test := range tests {
+		code, err := GenerateTOTP(rfc6238Secret, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Fatalf("GenerateTOTP: %s", err)
+		}
+		if code != test.code {
+			t.Errorf("at %d: expected %s, got %s", test.unix, test.code, code)
+		}
+	}
+
+	_, err := GenerateTOTP("not base32!", time.Now())
+	if err == nil {
+		t.Errorf("expected an error for invalid secret")
+	}
+}
+
+func TestKeyboardInteractiveRouting(t *testing.T) {
+	conf := SSHConf{User: "alice", Password: "secret", TOTPSecret: rfc6238Secret}
+	questions := []string{"Password: ", "One-time password: ", "OTP passcode: ", "Verification code: ", "Passphrase for key: "}
+	before, _ := GenerateTOTP(rfc6238Secret, time.Now())
+	answers, err := keyboardInteractive(conf, conf.challengeHandlers())("", "", questions, make([]bool, len(questions)))
+	if err != nil {
+		t.Fatalf("keyboard-interactive: %s", err)
+	}
+	after, _ := GenerateTOTP(rfc6238Secret, time.Now())
+	isCode := func(answer string) bool {
+		return answer == before || answer == after
+	}
+	if answers[0] != "secret" {
+		t.Errorf("expected password for %q, got %q", questions[0], answers[0])
+	}
+	for _, i := range []int{1, 2, 3} {
+		if !isCode(answers[i]) {
+			t.Errorf("expected totp code for %q, got %q", questions[i], answers[i])
+		}
+	}
+	if answers[4] != "secret" {
+		t.Errorf("expected password for %q, got %q", questions[4], answers[4])
+	}
+
+	// password handler alone must not answer one-time questions
+	_, ok, _ := ChallengePassword(conf, Challenge{Question: "One-time password: "})
+	if ok {
+		t.Errorf("password must not answer one-time password question")
+	}
+
+	_, err = keyboardInteractive(conf, conf.challengeHandlers())("", "", []string{"Favorite color? "}, []bool{true})
+	if err == nil {
+		t.Errorf("expected an error for unanswerable question")
+	}
+}
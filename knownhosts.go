@@ -0,0 +1,176 @@
+package sshbox
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyCheck is the way host keys are verified against known_hosts files
+type HostKeyCheck string
+
+const (
+	// HostKeyCheckStrict refuses hosts which are not in known_hosts files
+	HostKeyCheckStrict HostKeyCheck = "strict"
+	// HostKeyCheckAcceptNew trusts unknown hosts on first use by appending them to the first known_hosts file
+	// but still refuses hosts with a changed key
+	HostKeyCheckAcceptNew HostKeyCheck = "accept-new"
+	// HostKeyCheckOff does not verify host keys
+	HostKeyCheckOff HostKeyCheck = "off"
+)
+
+// knownHostsMu serializes appends to known_hosts files between ssh clients
+var knownHostsMu sync.Mutex
+
+func DefaultKnownHostsFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("No default known_hosts file: %s", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// loadKnownHosts builds a host key callback from known_hosts files, files which do not exist are considered empty
+func loadKnownHosts(files []string) (ssh.HostKeyCallback, error) {
+	existingFiles := make([]string, 0, len(files))
+	for _, file := range files {
+		_, err := os.Stat(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		existingFiles = append(existingFiles, file)
+	}
+	return knownhosts.New(existingFiles...)
+}
+
+// knownHostsCallback wraps a callback made by loadKnownHosts to apply the host key check mode.
+// When the key is refused, it stores a *HostKeyError in hostKeyErr as ssh handshake does not keep error type.
+func knownHostsCallback(callback ssh.HostKeyCallback, files []string, mode HostKeyCheck, hostKeyErr *error) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		var revokedErr *knownhosts.RevokedError
+		switch {
+		case errors.As(err, &revokedErr):
+			err = &HostKeyError{
+				Hostname:    hostname,
+				Fingerprint: base64Sha256Fingerprint(key),
+				Reason:      HostKeyRevoked,
+				Known:       []string{revokedErr.Revoked.String()},
+			}
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			if mode == HostKeyCheckAcceptNew && len(files) > 0 {
+				return appendKnownHost(files[0], hostname, key)
+			}
+			err = &HostKeyError{
+				Hostname:    hostname,
+				Fingerprint: base64Sha256Fingerprint(key),
+				Reason:      HostKeyUnknown,
+			}
+		case errors.As(err, &keyErr):
+			known := make([]string, len(keyErr.Want))
+			for i, want := range keyErr.Want {
+				known[i] = fmt.Sprintf("%s:%d", want.Filename, want.Line)
+			}
+			err = &HostKeyError{
+				Hostname:    hostname,
+				Fingerprint: base64Sha256Fingerprint(key),
+				Reason:      HostKeyChanged,
+				Known:       known,
+			}
+		}
+		*hostKeyErr = err
+		return err
+	}
+}
+
+// knownHostKeyAlgorithms returns host key algorithms matching keys known for the address to make
+// server present a key we can verify, as OpenSSH does. It returns nil when host is unknown.
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	portNum, _ := strconv.Atoi(port)
+	err = callback(address, &net.TCPAddr{IP: net.IPv4zero, Port: portNum}, probeKey{})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil
+	}
+	algos := make([]string, 0)
+	certAlgos := make([]string, 0)
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+			certAlgos = append(certAlgos, ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01)
+		case ssh.KeyAlgoDSA:
+			algos = append(algos, ssh.KeyAlgoDSA)
+			certAlgos = append(certAlgos, ssh.CertAlgoDSAv01)
+		case ssh.KeyAlgoECDSA256:
+			algos = append(algos, ssh.KeyAlgoECDSA256)
+			certAlgos = append(certAlgos, ssh.CertAlgoECDSA256v01)
+		case ssh.KeyAlgoECDSA384:
+			algos = append(algos, ssh.KeyAlgoECDSA384)
+			certAlgos = append(certAlgos, ssh.CertAlgoECDSA384v01)
+		case ssh.KeyAlgoECDSA521:
+			algos = append(algos, ssh.KeyAlgoECDSA521)
+			certAlgos = append(certAlgos, ssh.CertAlgoECDSA521v01)
+		case ssh.KeyAlgoED25519:
+			algos = append(algos, ssh.KeyAlgoED25519)
+			certAlgos = append(certAlgos, ssh.CertAlgoED25519v01)
+		default:
+			// a key type we can't map, let the server choose
+			return nil
+		}
+	}
+	return append(algos, certAlgos...)
+}
+
+// probeKey is a public key which never matches to list keys known for an host
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "sshbox-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("sshbox-probe")
+}
+
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return fmt.Errorf("probe key can't verify")
+}
+
+func appendKnownHost(file, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key))
+	if err != nil {
+		return err
+	}
+	logger.Warningf("Permanently added '%s' (%s) to the list of known hosts.", knownhosts.Normalize(hostname), key.Type())
+	return nil
+}
@@ -0,0 +1,158 @@
+package sshbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PACRules selects hosts going through socks or http proxy server of the box in a proxy auto-config file,
+// other hosts are reached directly
+type PACRules struct {
+	// Domains are domain suffixes, e.g. "corp.example.com" matches it and all its subdomains
+	Domains []string
+	// CIDRs are IPv4 networks, e.g. "10.0.0.0/8", matched against ip of host resolved by browser
+	CIDRs []string
+}
+
+func (r PACRules) check() error {
+	for _, domain := range r.Domains {
+		if pacDomain(domain) == "" {
+			return fmt.Errorf("Invalid PAC domain %q", domain)
+		}
+	}
+	for _, cidr := range r.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid PAC network: %s", err)
+		}
+		if ipNet.IP.To4() == nil {
+			return fmt.Errorf("Invalid PAC network %s: only IPv4 networks are supported", cidr)
+		}
+	}
+	return nil
+}
+
+// pacDomain removes wildcard and dots around a domain suffix
+func pacDomain(domain string) string {
+	return strings.Trim(strings.TrimPrefix(strings.TrimSpace(domain), "*"), ".")
+}
+
+// StartPACServer serves on local port a proxy auto-config file sending hosts matching rules to socks server,
+// or http proxy server, running on the box. File is generated on each request so it follows rules
+// changed with SetPACRules and proxy servers started or stopped afterwards. It blocks until PAC server is stopped.
+func (t *SSHBox) StartPACServer(port int, rules PACRules) error {
+	err := t.SetPACRules(rules)
+	if err != nil {
+		return err
+	}
+	entry := logger.WithField("target", t.config)
+	entry.Debugf("Starting listening PAC server on port %d", port)
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: t.PACHandler()}
+	stopPac := t.emitter.OnStopPac()
+	defer t.emitter.OffStopPac(stopPac)
+	go func() {
+		<-stopPac
+		entry.Debug("Stopping PAC server cause of emitted stop pac message")
+		server.Close()
+	}()
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (t *SSHBox) StopPACServer() {
+	t.emitter.EmitStopPac()
+}
+
+// SetPACRules changes rules of generated proxy auto-config file
+func (t *SSHBox) SetPACRules(rules PACRules) error {
+	err := rules.check()
+	if err != nil {
+		return err
+	}
+	t.proxyAddrsMu.Lock()
+	defer t.proxyAddrsMu.Unlock()
+	t.pacRules = rules
+	return nil
+}
+
+// PACHandler returns an http handler serving proxy auto-config file, to be mounted on an existing http server
+func (t *SSHBox) PACHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(t.PAC()))
+	})
+}
+
+// PAC generates proxy auto-config file from PAC rules and addresses of running proxy servers,
+// hosts matching rules are reached directly when no proxy server is running
+func (t *SSHBox) PAC() string {
+	t.proxyAddrsMu.Lock()
+	rules := t.pacRules
+	socksAddr := t.socksAddr
+	httpProxyAddr := t.httpProxyAddr
+	t.proxyAddrsMu.Unlock()
+
+	proxies := make([]string, 0)
+	if socksAddr != "" {
+		proxies = append(proxies, "SOCKS5 "+socksAddr, "SOCKS "+socksAddr)
+	}
+	if httpProxyAddr != "" {
+		proxies = append(proxies, "PROXY "+httpProxyAddr)
+	}
+	if len(proxies) == 0 {
+		proxies = append(proxies, "DIRECT")
+	}
+
+	pac := &strings.Builder{}
+	pac.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(pac, "  var proxy = %s;\n", jsString(strings.Join(proxies, "; ")))
+	for _, domain := range rules.Domains {
+		domain = pacDomain(domain)
+		fmt.Fprintf(pac, "  if (host == %s || dnsDomainIs(host, %s)) return proxy;\n", jsString(domain), jsString("."+domain))
+	}
+	if len(rules.CIDRs) > 0 {
+		pac.WriteString("  var ip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) ? host : dnsResolve(host);\n")
+		pac.WriteString("  if (ip) {\n")
+		for _, cidr := range rules.CIDRs {
+			_, ipNet, _ := net.ParseCIDR(cidr)
+			fmt.Fprintf(pac, "    if (isInNet(ip, %s, %s)) return proxy;\n", jsString(ipNet.IP.String()), jsString(net.IP(ipNet.Mask).String()))
+		}
+		pac.WriteString("  }\n")
+	}
+	pac.WriteString("  return \"DIRECT\";\n}\n")
+	return pac.String()
+}
+
+// setProxyAddr records address of a running proxy server for PAC, unspecified ip is replaced by loopback
+func (t *SSHBox) setProxyAddr(proxyAddr *string, addr net.Addr) {
+	t.proxyAddrsMu.Lock()
+	defer t.proxyAddrsMu.Unlock()
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		*proxyAddr = ""
+		return
+	}
+	ip := tcpAddr.IP
+	if ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	*proxyAddr = net.JoinHostPort(ip.String(), strconv.Itoa(tcpAddr.Port))
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
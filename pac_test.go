@@ -0,0 +1,162 @@
+package sshbox
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ArthurHlt/sshbox/freeports"
+)
+
+func newTestPACBox(t *testing.T) *SSHBox {
+	t.Helper()
+	server := newTestSSHServer(t)
+	box, err := NewSSHBox(server.conf())
+	if err != nil {
+		t.Fatalf("NewSSHBox: %s", err)
+	}
+	t.Cleanup(box.Close)
+	box.SetNameResolverFactory(func(sshBox *SSHBox) (NameResolver, error) {
+		return nil, nil
+	})
+	return box
+}
+
+// startTestHTTPProxyServer starts http proxy server of box on a free port and returns its address once it accepts connections,
+// StartHTTPProxyServer result is sent to done
+func startTestHTTPProxyServer(t *testing.T, box *SSHBox, done chan<- error) string {
+	t.Helper()
+	port, err := freeports.FreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		err := box.StartHTTPProxyServer(port)
+		if done != nil {
+			done <- err
+		}
+	}()
+	t.Cleanup(box.StopHTTPProxyServer)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("http proxy server not listening on %s", addr)
+	return ""
+}
+
+// waitPACProxy waits until proxies of generated PAC are the expected ones, proxy servers record their address
+// once listening
+func waitPACProxy(t *testing.T, box *SSHBox, proxy string) {
+	t.Helper()
+	expected := "  var proxy = " + jsString(proxy) + ";\n"
+	for i := 0; i < 100; i++ {
+		if strings.Contains(box.PAC(), expected) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected PAC proxies %q, got:\n%s", proxy, box.PAC())
+}
+
+func TestPAC(t *testing.T) {
+	box := newTestPACBox(t)
+	err := box.SetPACRules(PACRules{
+		Domains: []string{"*.corp.example.com", ".lab.", " Internal "},
+		CIDRs:   []string{"10.1.2.3/8", "192.168.1.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac := box.PAC()
+	for _, expected := range []string{
+		`  var proxy = "DIRECT";`,
+		`  if (host == "corp.example.com" || dnsDomainIs(host, ".corp.example.com")) return proxy;`,
+		`  if (host == "lab" || dnsDomainIs(host, ".lab")) return proxy;`,
+		`  if (host == "Internal" || dnsDomainIs(host, ".Internal")) return proxy;`,
+		`    if (isInNet(ip, "10.0.0.0", "255.0.0.0")) return proxy;`,
+		`    if (isInNet(ip, "192.168.1.0", "255.255.255.0")) return proxy;`,
+		`  return "DIRECT";`,
+	} {
+		if !strings.Contains(pac, expected+"\n") {
+			t.Errorf("expected PAC to contain %q, got:\n%s", expected, pac)
+		}
+	}
+
+	socksAddr := startTestSocksServer(t, box)
+	httpProxyAddr := startTestHTTPProxyServer(t, box, nil)
+	waitPACProxy(t, box, "SOCKS5 "+socksAddr+"; SOCKS "+socksAddr+"; PROXY "+httpProxyAddr)
+
+	box.StopSocksServer()
+	waitPACProxy(t, box, "PROXY "+httpProxyAddr)
+	box.StopHTTPProxyServer()
+	waitPACProxy(t, box, "DIRECT")
+}
+
+func TestPACRulesCheck(t *testing.T) {
+	box := newTestPACBox(t)
+	valid := PACRules{Domains: []string{"example.com"}, CIDRs: []string{"10.0.0.0/8"}}
+	err := box.SetPACRules(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rules := range []PACRules{
+		{CIDRs: []string{"fd00::/8"}},
+		{CIDRs: []string{"10.0.0.0"}},
+		{Domains: []string{"*."}},
+	} {
+		if err := box.SetPACRules(rules); err == nil {
+			t.Errorf("expected rules %+v to be rejected", rules)
+		}
+	}
+	if !strings.Contains(box.PAC(), `"example.com"`) {
+		t.Errorf("expected rejected rules to leave previous rules, got:\n%s", box.PAC())
+	}
+}
+
+func TestPACHandler(t *testing.T) {
+	box := newTestPACBox(t)
+	err := box.SetPACRules(PACRules{Domains: []string{"first.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(box.PACHandler())
+	defer server.Close()
+
+	get := func() string {
+		resp, err := http.Get(server.URL + "/proxy.pac")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/x-ns-proxy-autoconfig" {
+			t.Errorf("expected PAC content type, got %q", contentType)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if pac := get(); !strings.Contains(pac, `"first.example.com"`) {
+		t.Errorf("expected PAC with first rules, got:\n%s", pac)
+	}
+
+	err = box.SetPACRules(PACRules{Domains: []string{"second.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pac := get(); !strings.Contains(pac, `"second.example.com"`) || strings.Contains(pac, `"first.example.com"`) {
+		t.Errorf("expected PAC to be regenerated with new rules, got:\n%s", pac)
+	}
+}
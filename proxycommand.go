@@ -0,0 +1,210 @@
+package sshbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SshClientFactoryProxyCommand makes a factory establishing ssh over stdin and stdout of a local command,
+// like ProxyCommand of OpenSSH (e.g. "cloudflared access ssh --hostname %h").
+// %h, %p and %r in command are replaced by host, port and user of ssh server, stderr of command is logged
+// and command is killed when ssh client is closed
+func SshClientFactoryProxyCommand(command string) SshClientFactoryContext {
+	return func(ctx context.Context, conf SSHConf) (*ssh.Client, error) {
+		ctx, cancel := context.WithTimeout(ctx, conf.connectTimeout())
+		defer cancel()
+		conn, err := startProxyCommand(expandProxyCommand(command, conf))
+		if err != nil {
+			return nil, err
+		}
+		client, err := NewSSHClientFromConn(ctx, conf, conn)
+		if err != nil {
+			if _, ok := IsHostKeyError(err); ok {
+				return nil, err
+			}
+			if stderr := conn.lastStderr(); stderr != "" {
+				return nil, fmt.Errorf("%s (proxy command: %s)", err, stderr)
+			}
+			return nil, err
+		}
+		return client, nil
+	}
+}
+
+// expandProxyCommand replaces %h, %p, %r and %% tokens in command
+func expandProxyCommand(command string, conf SSHConf) string {
+	host, port, _ := net.SplitHostPort(conf.hostPort())
+	var result strings.Builder
+	for i := 0; i < len(command); i++ {
+		if command[i] != '%' || i == len(command)-1 {
+			result.WriteByte(command[i])
+			continue
+		}
+		i++
+		switch command[i] {
+		case 'h':
+			result.WriteString(host)
+		case 'p':
+			result.WriteString(port)
+		case 'r':
+			result.WriteString(conf.User)
+		case '%':
+			result.WriteByte('%')
+		default:
+			result.WriteByte('%')
+			result.WriteByte(command[i])
+		}
+	}
+	return result.String()
+}
+
+// proxyCommandConn is a net.Conn over stdin and stdout of a command
+type proxyCommandConn struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   *os.File
+	stdout  *os.File
+
+	stderrMu   sync.Mutex
+	stderrLast string
+
+	closeOnce sync.Once
+}
+
+func startProxyCommand(command string) (*proxyCommandConn, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		// exec replaces shell, killing the process kills the command and not only the shell
+		cmd = exec.Command("/bin/sh", "-c", "exec "+command)
+	}
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	// child ends are owned by the process from now on
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		stderrR.Close()
+		return nil, fmt.Errorf("Failed to start proxy command %s: %s", command, err)
+	}
+	logger.Debugf("Proxy command %s started with pid %d", command, cmd.Process.Pid)
+	conn := &proxyCommandConn{
+		command: command,
+		cmd:     cmd,
+		stdin:   stdinW,
+		stdout:  stdoutR,
+	}
+	go conn.logStderr(stderrR)
+	return conn, nil
+}
+
+func (c *proxyCommandConn) logStderr(stderr io.ReadCloser) {
+	defer stderr.Close()
+	entry := logger.WithField("proxy_command", c.command)
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		c.stderrMu.Lock()
+		c.stderrLast = line
+		c.stderrMu.Unlock()
+		entry.Info(line)
+	}
+}
+
+func (c *proxyCommandConn) lastStderr() string {
+	c.stderrMu.Lock()
+	defer c.stderrMu.Unlock()
+	return c.stderrLast
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *proxyCommandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// Close closes pipes and kills the command
+func (c *proxyCommandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.stdout.Close()
+		c.cmd.Process.Kill()
+		err := c.cmd.Wait()
+		logger.Debugf("Proxy command %s stopped: %v", c.command, err)
+	})
+	return nil
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr {
+	return proxyCommandAddr(c.command)
+}
+
+func (c *proxyCommandConn) RemoteAddr() net.Addr {
+	return proxyCommandAddr(c.command)
+}
+
+func (c *proxyCommandConn) SetDeadline(t time.Time) error {
+	err := c.stdout.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.stdin.SetWriteDeadline(t)
+}
+
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
+
+type proxyCommandAddr string
+
+func (a proxyCommandAddr) Network() string {
+	return "proxycommand"
+}
+
+func (a proxyCommandAddr) String() string {
+	return string(a)
+}
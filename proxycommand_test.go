@@ -0,0 +1,152 @@
+//go:build !windows
+// +build !windows
+
+package sshbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testProxyCommandEnv = "SSHBOX_TEST_PROXY_COMMAND_LOG"
+
+// TestProxyCommandHelperProcess is not a test, it is run as proxy command by tests. It writes its pid and arguments
+// to file of testProxyCommandEnv, then relays stdin and stdout to host and port given as arguments
+// or hangs for a minute without answering when mode is "hang".
+func TestProxyCommandHelperProcess(t *testing.T) {
+	logPath := os.Getenv(testProxyCommandEnv)
+	if logPath == "" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) != 5 {
+		fmt.Fprintf(os.Stderr, "usage: -- mode host port user, got %v\n", args)
+		os.Exit(2)
+	}
+	mode, host, port := args[1], args[2], args[3]
+	err := os.WriteFile(logPath, []byte(fmt.Sprintf("%d %s", os.Getpid(), strings.Join(args[1:], " "))), 0600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if mode == "hang" {
+		// only a kill ends it early, even once stdin is closed
+		io.Copy(io.Discard, os.Stdin)
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "helper can't reach server:", err)
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+// testProxyCommand returns a proxy command running helper process in mode, and path of file it logs to
+func testProxyCommand(t *testing.T, mode string) (string, string) {
+	t.Helper()
+	logPath := filepath.Join(t.TempDir(), "proxy-command.log")
+	t.Setenv(testProxyCommandEnv, logPath)
+	command := fmt.Sprintf("%q -test.run=^TestProxyCommandHelperProcess$ -- %s %%h %%p %%r", os.Args[0], mode)
+	return command, logPath
+}
+
+// readTestProxyCommandLog returns pid and arguments logged by helper process
+func readTestProxyCommandLog(t *testing.T, logPath string) (int, string) {
+	t.Helper()
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("proxy command did not run: %s", err)
+	}
+	pidRaw, args, _ := strings.Cut(string(content), " ")
+	pid, err := strconv.Atoi(pidRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pid, args
+}
+
+func waitTestProcessKilled(t *testing.T, pid int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("expected proxy command %d to be killed", pid)
+}
+
+func TestProxyCommand(t *testing.T) {
+	server := newTestSSHServer(t)
+	command, logPath := testProxyCommand(t, "relay")
+	conf := server.conf()
+	conf.ProxyCommand = command
+	box, err := NewSSHBox(conf)
+	if err != nil {
+		t.Fatalf("NewSSHBox through proxy command: %s", err)
+	}
+	defer box.Close()
+
+	session, err := box.SSHClient().NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := session.Output("echo hello")
+	if err != nil || string(output) != "hello\n" {
+		t.Errorf("expected command output through proxy command, got %q %v", output, err)
+	}
+
+	pid, args := readTestProxyCommandLog(t, logPath)
+	host, port, _ := net.SplitHostPort(server.addr())
+	if expected := fmt.Sprintf("relay %s %s %s", host, port, testSSHUser); args != expected {
+		t.Errorf("expected proxy command arguments %q, got %q", expected, args)
+	}
+	// box is closed before cleanups run
+	t.Cleanup(func() { waitTestProcessKilled(t, pid) })
+}
+
+func TestProxyCommandKilledOnContextDone(t *testing.T) {
+	server := newTestSSHServer(t)
+	command, logPath := testProxyCommand(t, "hang")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := SshClientFactoryProxyCommand(command)(ctx, server.conf())
+	if err == nil {
+		t.Fatalf("expected ssh handshake through a silent proxy command to fail")
+	}
+	pid, _ := readTestProxyCommandLog(t, logPath)
+	waitTestProcessKilled(t, pid)
+}
+
+func TestExpandProxyCommand(t *testing.T) {
+	conf := SSHConf{Host: "example.com:2222", User: "bob"}
+	tests := map[string]string{
+		"nc %h %p":          "nc example.com 2222",
+		"ssh -W %h:%p %r@j": "ssh -W example.com:2222 bob@j",
+		"echo 100%% %x %":   "echo 100% %x %",
+	}
+	for command, expected := range tests {
+		if expanded := expandProxyCommand(command, conf); expanded != expected {
+			t.Errorf("expected %q to expand to %q, got %q", command, expected, expanded)
+		}
+	}
+}
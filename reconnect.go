@@ -0,0 +1,161 @@
+package sshbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const keepaliveTimeout = 15 * time.Second
+
+// ReconnectPolicy describes how an SSHBox re-dials its ssh server when the connection is lost.
+// Local listeners of tunnels and socks servers stay open while reconnecting and reverse tunnels
+// are registered again on the new connection.
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of dials before giving up, 0 means retrying forever
+	MaxAttempts int
+	// InitialBackoff is the wait before the first dial, defaults to 1 second
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between two dials, defaults to 1 minute
+	MaxBackoff time.Duration
+	// Multiplier is applied to the wait after each failed dial, defaults to 2
+	Multiplier float64
+}
+
+func (p *ReconnectPolicy) CheckAndFill() error {
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("max attempts must not be negative")
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Minute
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	return nil
+}
+
+func (p ReconnectPolicy) nextBackoff(current time.Duration) time.Duration {
+	next := time.Duration(float64(current) * p.Multiplier)
+	if next > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return next
+}
+
+// waitReconnect waits for a reconnection in progress and returns true if the client given has been replaced
+func (t *SSHBox) waitReconnect(ctx context.Context, client *ssh.Client) bool {
+	if t.reconnectPolicy == nil {
+		return false
+	}
+	t.clientMu.RLock()
+	done := t.reconnectDone
+	t.clientMu.RUnlock()
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return t.isReplaced(client)
+}
+
+// ensureReconnected replaces the failed client by a new one, starting a reconnection if none is in progress.
+// It returns false if the box is closed, has no reconnect policy or gave up on reconnecting
+func (t *SSHBox) ensureReconnected(failed *ssh.Client) bool {
+	if t.reconnectPolicy == nil {
+		return false
+	}
+	t.clientMu.Lock()
+	if t.closed || t.reconnectFailed {
+		t.clientMu.Unlock()
+		return false
+	}
+	if t.sshClient != failed {
+		t.clientMu.Unlock()
+		return true
+	}
+	done := t.reconnectDone
+	if done == nil {
+		done = make(chan struct{})
+		t.reconnectDone = done
+		go t.reconnect(failed, done)
+	}
+	t.clientMu.Unlock()
+	<-done
+	return t.isReplaced(failed)
+}
+
+func (t *SSHBox) isReplaced(client *ssh.Client) bool {
+	t.clientMu.RLock()
+	defer t.clientMu.RUnlock()
+	return !t.closed && t.sshClient != client
+}
+
+func (t *SSHBox) reconnect(failed *ssh.Client, done chan struct{}) {
+	reconnected, gaveUp := t.redial(failed)
+	// waiting dialers are released before emitting so that a subscriber not draining events can not block them
+	close(done)
+	if reconnected {
+		t.emitter.emitReconnected()
+	}
+	if gaveUp {
+		t.emitter.EmitStopSocks()
+		t.emitter.EmitStopHttpProxy()
+		t.emitter.EmitStopTunnels()
+	}
+}
+
+// redial dials ssh server following reconnect policy until it succeeds, box is closed or attempts are exhausted
+func (t *SSHBox) redial(failed *ssh.Client) (reconnected bool, gaveUp bool) {
+	failed.Close()
+	policy := *t.reconnectPolicy
+	subStop := t.emitter.OnStopSsh()
+	defer t.emitter.OffStopSsh(subStop)
+	entry := logger.WithField("target", t.config)
+	backoff := policy.InitialBackoff
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-subStop:
+			t.clientMu.Lock()
+			t.reconnectDone = nil
+			t.clientMu.Unlock()
+			return false, false
+		}
+		entry.Debugf("Reconnecting ssh client, attempt %d ...", attempt)
+		client, err := t.makeSSHClient(t.ctx)
+		if err != nil {
+			entry.Warningf("Reconnection attempt %d failed: %s", attempt, err.Error())
+			backoff = policy.nextBackoff(backoff)
+			continue
+		}
+		t.clientMu.Lock()
+		if t.closed {
+			t.reconnectDone = nil
+			t.clientMu.Unlock()
+			client.Close()
+			return false, false
+		}
+		t.sshClient = client
+		t.reconnectDone = nil
+		t.clientMu.Unlock()
+		entry.Infof("Reconnected after %d attempt(s)", attempt)
+		return true, false
+	}
+	t.clientMu.Lock()
+	t.reconnectFailed = true
+	t.reconnectDone = nil
+	t.clientMu.Unlock()
+	logger.Warningf("Stopping proxy servers and tunnels because ssh could not reconnect after %d attempts", policy.MaxAttempts)
+	return false, true
+}
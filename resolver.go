@@ -3,7 +3,6 @@ package sshbox
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"net"
 	"time"
 
@@ -64,58 +63,87 @@ func (n nameResolverSimple) Resolve(ctx context.Context, name string) (context.C
 }
 
 func DnsConfFromSSH(sshBox *SSHBox) (*DnsConfig, error) {
+	b, err := catFromSSH(sshBox, "/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	dnsConf := dnsReadConfig(bytes.NewReader(b))
+	return dnsConf, nil
+}
+
+// HostsFromSSH reads hosts file of ssh server, ips are indexed by lowercase name
+func HostsFromSSH(sshBox *SSHBox) (map[string][]net.IP, error) {
+	b, err := catFromSSH(sshBox, "/etc/hosts")
+	if err != nil {
+		return nil, err
+	}
+	return dnsReadHosts(bytes.NewReader(b)), nil
+}
+
+func catFromSSH(sshBox *SSHBox, path string) ([]byte, error) {
 	session, err := sshBox.SSHClient().NewSession()
 	if err != nil {
 		return nil, err
 	}
-	b, err := session.Output("cat /etc/resolv.conf")
+	b, err := session.Output("cat " + path)
 	session.Close() // close even on success
 	if err != nil {
 		return nil, err
 	}
-	dnsConf := dnsReadConfig(bytes.NewReader(b))
-	return dnsConf, nil
+	return b, nil
 }
 
 func NameResolverFactoryTunnels(dnsservers []string) func(sshBox *SSHBox) (NameResolver, error) {
 	return func(sshBox *SSHBox) (NameResolver, error) {
-		tunnels, err := DNSServerToTunnel(dnsservers)
+		servers, err := tunnelDNSServers(sshBox, dnsservers)
 		if err != nil {
 			return nil, err
 		}
-		if len(tunnels) == 0 {
+		if len(servers) == 0 {
 			return nil, nil
 		}
-
-		servers := make([]string, len(tunnels))
-		for i, tunnel := range tunnels {
-			startListen := make(chan bool, 1)
-			errTunnel := make(chan error, 1)
-			go func() {
-				err := sshBox.listenLocal(nil, tunnel, startListen)
-				if err != nil {
-					errTunnel <- err
-				}
-			}()
-			servers[i] = fmt.Sprintf("127.0.0.1:%d", tunnel.LocalPort)
-			select {
-			case err := <-errTunnel:
-				return nil, err
-			case <-startListen:
-				continue
-			}
-		}
-
 		return NewNameResolverSimple(servers), nil
 	}
 }
 
+// NameResolverFactorySSH resolves names like ssh server does: hosts file first, then nameservers
+// with search, ndots, timeout, attempts and rotate options from its resolv.conf
 func NameResolverFactorySSH(sshBox *SSHBox) (NameResolver, error) {
 	dnsConf, err := DnsConfFromSSH(sshBox)
 	if err != nil {
 		return nil, err
 	}
-	return NameResolverFactoryTunnels(dnsConf.Servers)(sshBox)
+	hosts, err := HostsFromSSH(sshBox)
+	if err != nil {
+		logger.WithField("target", sshBox.config).Debugf("Hosts file of ssh server not used: %s", err)
+	}
+	nameservers := dnsConf.Servers
+	if len(nameservers) == 0 {
+		// like glibc, a local nameserver is used when resolv.conf has none
+		nameservers = []string{"127.0.0.1"}
+	}
+	servers, err := tunnelDNSServers(sshBox, nameservers)
+	if err != nil {
+		return nil, err
+	}
+	return NewNameResolverDnsConf(servers, dnsConf, hosts), nil
+}
+
+// tunnelDNSServers opens a tunnel to each dns server and returns their local addresses
+func tunnelDNSServers(sshBox *SSHBox, dnsservers []string) ([]string, error) {
+	tunnels, err := DNSServerToTunnel(dnsservers)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]string, len(tunnels))
+	for i, target := range tunnels {
+		tunnel, err := sshBox.AddTunnel(target)
+		if err != nil {
+			return nil, err
+		}
+		servers[i] = tunnel.Addr().String()
+	}
+	return servers, nil
 }
 
 func DNSServerToTunnel(dnsservers []string) ([]*TunnelTarget, error) {
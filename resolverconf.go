@@ -0,0 +1,277 @@
+package sshbox
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errDNSNotFound = errors.New("no such host")
+
+// nameResolverDnsConf resolves names with hosts entries first, then by querying servers over tcp
+// following search, ndots, timeout, attempts and rotate options of a resolv.conf
+type nameResolverDnsConf struct {
+	servers []string
+	conf    *DnsConfig
+	hosts   map[string][]net.IP
+	next    uint32
+}
+
+// NewNameResolverDnsConf creates a name resolver querying servers as described by conf, hosts can be nil,
+// without servers only hosts entries are resolved and nil is returned when there is neither
+func NewNameResolverDnsConf(servers []string, conf *DnsConfig, hosts map[string][]net.IP) NameResolver {
+	if len(servers) == 0 && len(hosts) == 0 {
+		return nil
+	}
+	withDefaults := *conf
+	if withDefaults.Ndots < 0 {
+		withDefaults.Ndots = 1
+	}
+	if withDefaults.Timeout < 1 {
+		withDefaults.Timeout = 5
+	}
+	if withDefaults.Attempts < 1 {
+		withDefaults.Attempts = 2
+	}
+	return &nameResolverDnsConf{
+		servers: servers,
+		conf:    &withDefaults,
+		hosts:   hosts,
+	}
+}
+
+func (n *nameResolverDnsConf) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, ip, nil
+	}
+	if ip := preferIPv4(n.hosts[strings.ToLower(strings.TrimSuffix(name, "."))]); ip != nil {
+		return ctx, ip, nil
+	}
+	var err error = &net.DNSError{Err: errDNSNotFound.Error(), Name: name, IsNotFound: true}
+	for _, fqdn := range n.nameList(name) {
+		ip, lookupErr := n.lookup(ctx, fqdn)
+		if lookupErr == nil {
+			return ctx, ip, nil
+		}
+		if ctx.Err() != nil {
+			return ctx, nil, ctx.Err()
+		}
+		if !errors.Is(lookupErr, errDNSNotFound) {
+			err = &net.DNSError{Err: lookupErr.Error(), Name: name}
+		}
+	}
+	return ctx, nil, err
+}
+
+// nameList gives absolute names to query in order, as resolv.conf(5) describes search and ndots
+func (n *nameResolverDnsConf) nameList(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	hasNdots := strings.Count(name, ".") >= n.conf.Ndots
+	names := make([]string, 0, len(n.conf.Search)+1)
+	if hasNdots {
+		names = append(names, name+".")
+	}
+	for _, suffix := range n.conf.Search {
+		suffix = strings.Trim(suffix, ".")
+		if suffix != "" {
+			names = append(names, name+"."+suffix+".")
+		}
+	}
+	if !hasNdots {
+		names = append(names, name+".")
+	}
+	return names
+}
+
+// lookup queries ipv4 addresses of fqdn, ipv6 ones are queried when it has none
+func (n *nameResolverDnsConf) lookup(ctx context.Context, fqdn string) (net.IP, error) {
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		ips, err := n.exchange(ctx, fqdn, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) > 0 {
+			return ips[0], nil
+		}
+	}
+	return nil, errDNSNotFound
+}
+
+// exchange tries each server in turn, starting from the next one when rotate is set, for conf attempts
+func (n *nameResolverDnsConf) exchange(ctx context.Context, fqdn string, qtype dnsmessage.Type) ([]net.IP, error) {
+	servers := n.servers
+	if len(servers) == 0 {
+		return nil, errDNSNotFound
+	}
+	if n.conf.Rotate {
+		start := int(atomic.AddUint32(&n.next, 1)-1) % len(servers)
+		servers = append(append([]string{}, servers[start:]...), servers[:start]...)
+	}
+	var err error
+	for attempt := 0; attempt < n.conf.Attempts; attempt++ {
+		for _, server := range servers {
+			var ips []net.IP
+			ips, err = n.query(ctx, server, fqdn, qtype)
+			if err == nil || errors.Is(err, errDNSNotFound) {
+				return ips, err
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logger.Debugf("Dns query of %s to %s failed: %s", fqdn, server, err)
+		}
+	}
+	return nil, err
+}
+
+func (n *nameResolverDnsConf) query(ctx context.Context, server, fqdn string, qtype dnsmessage.Type) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, err
+	}
+	idBytes := make([]byte, 2)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+	builder := dnsmessage.NewBuilder(make([]byte, 2, 514), dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	err = builder.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	err = builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	req, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	// messages over tcp are prefixed by their length
+	binary.BigEndian.PutUint16(req, uint16(len(req)-2))
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(n.conf.Timeout)*time.Second)
+	defer cancel()
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return nil, err
+	}
+	resp = make([]byte, binary.BigEndian.Uint16(resp))
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, fmt.Errorf("Invalid dns response from %s", server)
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, errDNSNotFound
+	default:
+		return nil, fmt.Errorf("Dns server %s answered %s", server, header.RCode)
+	}
+	err = parser.SkipAllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0)
+	for {
+		answer, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return ips, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case answer.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			a, err := parser.AResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case answer.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			aaaa, err := parser.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, net.IP(aaaa.AAAA[:]))
+		default:
+			// cname records are followed by records of canonical name in answers
+			err = parser.SkipAnswer()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// dnsReadHosts reads a hosts(5) file, ips are indexed by lowercase name and aliases
+func dnsReadHosts(hostsReader io.Reader) map[string][]net.IP {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(hostsReader)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		addr, _, _ := strings.Cut(f[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		for _, name := range f[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts
+}
+
+func preferIPv4(ips []net.IP) net.IP {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0]
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package sshbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testDNSAnsweredName = "db1.example.com."
+
+var testDNSAnsweredIP = net.ParseIP("192.0.2.10")
+
+// testDNSServer is a dns server over tcp answering A queries of testDNSAnsweredName only, queried names are recorded
+type testDNSServer struct {
+	addr string
+	// rcode is answered to every query when set
+	rcode dnsmessage.RCode
+	// hang reads queries without ever answering them
+	hang    bool
+	mu      sync.Mutex
+	queries []string
+}
+
+func newTestDNSServer(t *testing.T, configure func(s *testDNSServer)) *testDNSServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s := &testDNSServer{addr: listener.Addr().String()}
+	if configure != nil {
+		configure(s)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testDNSServer) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.queries...)
+}
+
+func (s *testDNSServer) handle(conn net.Conn) {
+	defer conn.Close()
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return
+	}
+	req := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return
+	}
+	question := msg.Questions[0]
+	s.mu.Lock()
+	s.queries = append(s.queries, question.Name.String())
+	s.mu.Unlock()
+	if s.hang {
+		io.Copy(io.Discard, conn)
+		return
+	}
+
+	msg.Header.Response = true
+	switch {
+	case s.rcode != dnsmessage.RCodeSuccess:
+		msg.Header.RCode = s.rcode
+	case question.Name.String() != testDNSAnsweredName:
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	case question.Type == dnsmessage.TypeA:
+		var a [4]byte
+		copy(a[:], testDNSAnsweredIP.To4())
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	resp, err := msg.AppendPack(make([]byte, 2, 514))
+	if err != nil {
+		return
+	}
+	binary.BigEndian.PutUint16(resp, uint16(len(resp)-2))
+	conn.Write(resp)
+}
+
+func TestNameResolverDnsConfSearch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ndots   int
+		found   bool
+		queries []string
+	}{
+		// below ndots, search list is tried before absolute name
+		{name: "db1", ndots: 1, found: true, queries: []string{"db1.example.com."}},
+		{name: "web", ndots: 1, queries: []string{"web.example.com.", "web."}},
+		{name: "db1.example", ndots: 2, queries: []string{"db1.example.example.com.", "db1.example."}},
+		// at or above ndots, absolute name is tried first
+		{name: "db1.example.com", ndots: 1, found: true, queries: []string{"db1.example.com."}},
+		{name: "web.example.org", ndots: 2, queries: []string{"web.example.org.", "web.example.org.example.com."}},
+		// absolute names are never expanded
+		{name: "web.", ndots: 1, queries: []string{"web."}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestDNSServer(t, nil)
+			resolver := NewNameResolverDnsConf([]string{server.addr}, &DnsConfig{
+				Search: []string{"example.com"},
+				Ndots:  test.ndots,
+			}, nil)
+			_, ip, err := resolver.Resolve(context.Background(), test.name)
+			if test.found && (err != nil || !ip.Equal(testDNSAnsweredIP)) {
+				t.Errorf("expected %s, got %s %v", testDNSAnsweredIP, ip, err)
+			}
+			var dnsErr *net.DNSError
+			if !test.found && (!errors.As(err, &dnsErr) || !dnsErr.IsNotFound) {
+				t.Errorf("expected not found error, got %s %v", ip, err)
+			}
+			if queries := server.names(); !reflect.DeepEqual(queries, test.queries) {
+				t.Errorf("expected queries %v, got %v", test.queries, queries)
+			}
+		})
+	}
+}
+
+func TestNameResolverDnsConfAttempts(t *testing.T) {
+	failing := func(s *testDNSServer) { s.rcode = dnsmessage.RCodeServerFailure }
+	first := newTestDNSServer(t, failing)
+	second := newTestDNSServer(t, failing)
+	resolver := NewNameResolverDnsConf([]string{first.addr, second.addr}, &DnsConfig{Attempts: 3}, nil)
+	_, _, err := resolver.Resolve(context.Background(), testDNSAnsweredName)
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		t.Errorf("expected a server failure, got %v", err)
+	}
+	// each attempt goes through all servers
+	for _, server := range []*testDNSServer{first, second} {
+		if queries := server.names(); len(queries) != 3 {
+			t.Errorf("expected 3 queries to %s, got %v", server.addr, queries)
+		}
+	}
+}
+
+func TestNameResolverDnsConfTimeout(t *testing.T) {
+	hanging := newTestDNSServer(t, func(s *testDNSServer) { s.hang = true })
+	answering := newTestDNSServer(t, nil)
+	resolver := NewNameResolverDnsConf([]string{hanging.addr, answering.addr}, &DnsConfig{Timeout: 1, Attempts: 1}, nil)
+	start := time.Now()
+	_, ip, err := resolver.Resolve(context.Background(), testDNSAnsweredName)
+	if err != nil || !ip.Equal(testDNSAnsweredIP) {
+		t.Fatalf("expected answer of next server, got %s %v", ip, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("expected hanging server to be given up after 1 second, took %s", elapsed)
+	}
+}
+
+func TestNameResolverDnsConfRotate(t *testing.T) {
+	for _, rotate := range []bool{false, true} {
+		first := newTestDNSServer(t, nil)
+		second := newTestDNSServer(t, nil)
+		resolver := NewNameResolverDnsConf([]string{first.addr, second.addr}, &DnsConfig{Rotate: rotate}, nil)
+		for i := 0; i < 4; i++ {
+			_, _, err := resolver.Resolve(context.Background(), testDNSAnsweredName)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected := []int{4, 0}
+		if rotate {
+			expected = []int{2, 2}
+		}
+		if got := []int{len(first.names()), len(second.names())}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected queries per server %v with rotate %t, got %v", expected, rotate, got)
+		}
+	}
+}
+
+func TestNameResolverDnsConfHosts(t *testing.T) {
+	server := newTestDNSServer(t, nil)
+	resolver := NewNameResolverDnsConf([]string{server.addr}, &DnsConfig{}, map[string][]net.IP{
+		"box.local": {net.ParseIP("192.0.2.1")},
+	})
+	_, ip, err := resolver.Resolve(context.Background(), "BOX.local.")
+	if err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected hosts entry, got %s %v", ip, err)
+	}
+	if queries := server.names(); len(queries) != 0 {
+		t.Errorf("expected hosts entry to be resolved without query, got %v", queries)
+	}
+}
+
+func TestNameResolverDnsConfHostsOnly(t *testing.T) {
+	if resolver := NewNameResolverDnsConf(nil, &DnsConfig{Rotate: true}, nil); resolver != nil {
+		t.Errorf("expected no resolver without servers and hosts, got %#v", resolver)
+	}
+
+	resolver := NewNameResolverDnsConf(nil, &DnsConfig{Rotate: true}, map[string][]net.IP{
+		"box.local": {net.ParseIP("192.0.2.1")},
+	})
+	if resolver == nil {
+		t.Fatal("expected a resolver for hosts entries")
+	}
+	_, ip, err := resolver.Resolve(context.Background(), "box.local")
+	if err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected hosts entry, got %s %v", ip, err)
+	}
+	_, _, err = resolver.Resolve(context.Background(), "example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
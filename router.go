@@ -0,0 +1,288 @@
+package sshbox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ArthurHlt/go-socks5"
+	"github.com/sirupsen/logrus"
+	netctx "golang.org/x/net/context"
+)
+
+// Route sends destinations matching one of Domains or CIDRs, on one of Ports, through Box
+type Route struct {
+	// Domains are globs matched against destination names, e.g. "*.prod.example.com" or "db-?.lab"
+	Domains []string
+	// CIDRs are networks matched against destination ips, names which match no domain are resolved with
+	// name resolver of Box to be matched
+	CIDRs []string
+	// Ports restricts route to these destination ports, all ports match when empty.
+	// A route with only ports matches all destinations on these ports.
+	Ports []int
+	// Box is the box destinations are dialed through, destinations are dialed from local machine when nil
+	Box *SSHBox
+
+	networks []*net.IPNet
+}
+
+func (r Route) String() string {
+	if r.Box == nil {
+		return "direct"
+	}
+	return r.Box.config.String()
+}
+
+func (r *Route) checkAndFill() error {
+	r.networks = make([]*net.IPNet, 0, len(r.CIDRs))
+	for _, cidr := range r.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid route network: %s", err)
+		}
+		r.networks = append(r.networks, ipNet)
+	}
+	for _, domain := range r.Domains {
+		_, err := path.Match(domain, "")
+		if err != nil {
+			return fmt.Errorf("Invalid route domain %q: %s", domain, err)
+		}
+	}
+	return nil
+}
+
+func (r Route) matchPort(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Route) matchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range r.Domains {
+		if ok, _ := path.Match(strings.ToLower(domain), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Route) matchIP(ip net.IP) bool {
+	for _, ipNet := range r.networks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Router fronts socks and http proxy servers whose destinations are dispatched across several boxes,
+// or dialed directly, following routes in order
+type Router struct {
+	routes       []Route
+	defaultRoute Route
+	emitter      *Emitter
+}
+
+// NewRouter creates a router using routes in order, destinations matching no route go through defaultBox
+// or are dialed directly when it is nil
+func NewRouter(defaultBox *SSHBox, routes ...Route) (*Router, error) {
+	for i := range routes {
+		err := routes[i].checkAndFill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Router{
+		routes:       routes,
+		defaultRoute: Route{Box: defaultBox},
+		emitter:      NewEmitter(),
+	}, nil
+}
+
+// routedAddr is a destination with the route it matched
+type routedAddr struct {
+	route Route
+	host  string
+	port  string
+	// ip is set when host has been resolved by route
+	ip net.IP
+}
+
+func (a routedAddr) dial(ctx context.Context, network string) (net.Conn, error) {
+	host := a.host
+	if a.ip != nil {
+		host = a.ip.String()
+	}
+	addr := net.JoinHostPort(host, a.port)
+	if a.route.Box == nil {
+		dialer := &net.Dialer{}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	nameResolver, err := a.route.Box.nameResolver()
+	if err != nil {
+		return nil, err
+	}
+	return a.route.Box.dialResolved(ctx, nameResolver, network, addr)
+}
+
+// Route returns the route addr matches
+func (r *Router) Route(ctx context.Context, addr string) (Route, error) {
+	routed, err := r.route(ctx, addr)
+	if err != nil {
+		return Route{}, err
+	}
+	return routed.route, nil
+}
+
+func (r *Router) route(ctx context.Context, addr string) (routedAddr, error) {
+	host, portRaw, err := net.SplitHostPort(addr)
+	if err != nil {
+		return routedAddr{}, err
+	}
+	port, err := strconv.Atoi(portRaw)
+	if err != nil {
+		return routedAddr{}, fmt.Errorf("Invalid port %s", portRaw)
+	}
+	ip := net.ParseIP(host)
+	// names are resolved at most once per box while looking for a route
+	resolved := make(map[*SSHBox]net.IP)
+	for _, route := range r.routes {
+		if !route.matchPort(port) {
+			continue
+		}
+		if len(route.Domains) == 0 && len(route.networks) == 0 {
+			return routedAddr{route: route, host: host, port: portRaw}, nil
+		}
+		if ip != nil {
+			if route.matchIP(ip) {
+				return routedAddr{route: route, host: host, port: portRaw}, nil
+			}
+			continue
+		}
+		if route.matchDomain(host) {
+			return routedAddr{route: route, host: host, port: portRaw}, nil
+		}
+		if len(route.networks) == 0 {
+			continue
+		}
+		hostIP, ok := resolved[route.Box]
+		if !ok {
+			hostIP, err = resolveWithBox(ctx, route.Box, host)
+			if err != nil {
+				logger.Debugf("Failed to resolve %s for route %s: %s", host, route, err)
+			}
+			resolved[route.Box] = hostIP
+		}
+		if hostIP != nil && route.matchIP(hostIP) {
+			return routedAddr{route: route, host: host, port: portRaw, ip: hostIP}, nil
+		}
+	}
+	return routedAddr{route: r.defaultRoute, host: host, port: portRaw}, nil
+}
+
+// resolveWithBox resolves name with name resolver of box, or locally when box is nil, no ip is returned
+// when box has no name resolver
+func resolveWithBox(ctx context.Context, box *SSHBox, name string) (net.IP, error) {
+	if box == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", name)
+		if err != nil {
+			return nil, err
+		}
+		return ips[0], nil
+	}
+	nameResolver, err := box.nameResolver()
+	if err != nil {
+		return nil, err
+	}
+	if nameResolver == nil {
+		logger.Warningf("Box %s has no name resolver, %s can't be matched against networks of its routes", box.config, name)
+		return nil, nil
+	}
+	_, ip, err := nameResolver.Resolve(ctx, name)
+	return ip, err
+}
+
+// DialContext dials addr through the box of the route it matches
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	routed, err := r.route(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Routing %s to %s", addr, routed.route)
+	return routed.dial(ctx, network)
+}
+
+// StartSocksServer serves a socks5 server on local port dispatching connections with routes,
+// conf can be nil, its Dial and Resolver are replaced. It blocks until socks server is stopped.
+func (r *Router) StartSocksServer(port int, conf *socks5.Config) error {
+	// conf of caller is copied, it may be shared with other servers
+	socksConf := &socks5.Config{}
+	if conf != nil {
+		c := *conf
+		socksConf = &c
+	}
+	socksConf.Dial = r.DialContext
+	// names are kept to be matched against routes and resolved by the matching box
+	socksConf.Resolver = routerResolver{}
+	server, err := socks5.New(socksConf)
+	if err != nil {
+		return errLoadErrorf("new socks5 server: %s", err)
+	}
+	logger.Debugf("Starting listening router socks5 server on port %d", port)
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	stopSocks := r.emitter.OnStopSocks()
+	defer r.emitter.OffStopSocks(stopSocks)
+	go func() {
+		<-stopSocks
+		logger.Debug("Stopping router socks cause of emitted stop socks message")
+		listener.Close()
+	}()
+	return server.Serve(listener)
+}
+
+// StartHTTPProxyServer serves an http proxy on local port dispatching connections with routes,
+// clients must authenticate when credentials is not nil. It blocks until http proxy is stopped.
+func (r *Router) StartHTTPProxyServer(port int, credentials socks5.CredentialStore) error {
+	proxy := newHTTPProxy(r.DialContext, credentials, SSHConf{}.connectTimeout())
+	entry := logrus.NewEntry(logger)
+	entry.Debugf("Starting listening router http proxy server on port %d", port)
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	return proxy.serve(listener, r.emitter, entry)
+}
+
+func (r *Router) StopSocksServer() {
+	r.emitter.EmitStopSocks()
+}
+
+func (r *Router) StopHTTPProxyServer() {
+	r.emitter.EmitStopHttpProxy()
+}
+
+// Close stops socks and http proxy servers of router, boxes are left open
+func (r *Router) Close() {
+	r.emitter.EmitStopSocks()
+	r.emitter.EmitStopHttpProxy()
+}
+
+// routerResolver leaves names unresolved so that socks server dials them by name
+type routerResolver struct{}
+
+func (routerResolver) Resolve(ctx netctx.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
@@ -0,0 +1,173 @@
+package sshbox
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/ArthurHlt/sshbox/freeports"
+)
+
+// newTestRouterBox creates a box on a new test server resolving names with hosts only, resolver is nil when hosts is nil
+func newTestRouterBox(t *testing.T, hosts map[string][]net.IP) (*SSHBox, *testSSHServer) {
+	t.Helper()
+	server := newTestSSHServer(t)
+	box, err := NewSSHBox(server.conf())
+	if err != nil {
+		t.Fatalf("NewSSHBox: %s", err)
+	}
+	t.Cleanup(box.Close)
+	box.SetNameResolverFactory(func(sshBox *SSHBox) (NameResolver, error) {
+		if hosts == nil {
+			return nil, nil
+		}
+		return NewNameResolverDnsConf(nil, &DnsConfig{}, hosts), nil
+	})
+	return box, server
+}
+
+func sameRoute(a, b Route) bool {
+	return a.Box == b.Box && reflect.DeepEqual(a.Domains, b.Domains) &&
+		reflect.DeepEqual(a.CIDRs, b.CIDRs) && reflect.DeepEqual(a.Ports, b.Ports)
+}
+
+func TestRouter(t *testing.T) {
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+	boxA, serverA := newTestRouterBox(t, map[string][]net.IP{
+		"db.alpha.test": loopback,
+		"svc.a":         {net.ParseIP("10.1.0.5")},
+	})
+	boxB, serverB := newTestRouterBox(t, map[string][]net.IP{
+		"svc.b": loopback,
+	})
+	portRouted := newTestTCPTarget(t)
+	target := strconv.Itoa(newTestTCPTarget(t))
+
+	alpha := Route{Domains: []string{"*.alpha.test"}, Box: boxA}
+	byPort := Route{Ports: []int{portRouted}, Box: boxB}
+	networkA := Route{CIDRs: []string{"10.1.0.0/16"}, Box: boxA}
+	direct := Route{Domains: []string{"localhost"}}
+	loopbackB := Route{CIDRs: []string{"127.0.0.0/8"}, Box: boxB}
+	defaultRoute := Route{Box: boxA}
+	router, err := NewRouter(boxA, alpha, byPort, networkA, direct, loopbackB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr  string
+		route Route
+	}{
+		{"db.alpha.test:80", alpha},
+		// routes are matched in order
+		{"db.alpha.test:" + strconv.Itoa(portRouted), alpha},
+		{"other.test:" + strconv.Itoa(portRouted), byPort},
+		// names are resolved by box of route to be matched against its networks
+		{"svc.a:80", networkA},
+		{"10.1.2.3:80", networkA},
+		{"svc.b:80", loopbackB},
+		{"127.0.0.1:80", loopbackB},
+		{"localhost:80", direct},
+		{"unknown.test:80", defaultRoute},
+	}
+	for _, test := range tests {
+		route, err := router.Route(context.Background(), test.addr)
+		if err != nil {
+			t.Errorf("route %s: %s", test.addr, err)
+			continue
+		}
+		if !sameRoute(route, test.route) {
+			t.Errorf("expected %s to be routed to %+v, got %+v", test.addr, test.route, route)
+		}
+	}
+
+	dials := []struct {
+		addr string
+		// through is the server expected to dial addr, addr is dialed directly when empty
+		through string
+	}{
+		{"db.alpha.test:" + target, "A"},
+		{"127.0.0.1:" + strconv.Itoa(portRouted), "B"},
+		{"svc.b:" + target, "B"},
+		{"localhost:" + target, ""},
+	}
+	for _, dial := range dials {
+		expected := map[string]int{"A": len(serverA.directDials()), "B": len(serverB.directDials())}
+		conn, err := router.DialContext(context.Background(), "tcp", dial.addr)
+		if err != nil {
+			t.Errorf("dial %s: %s", dial.addr, err)
+			continue
+		}
+		conn.Close()
+		if dial.through != "" {
+			expected[dial.through]++
+		}
+		got := map[string]int{"A": len(serverA.directDials()), "B": len(serverB.directDials())}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %s to be dialed through %q, got dials %v and %v",
+				dial.addr, dial.through, serverA.directDials(), serverB.directDials())
+		}
+	}
+}
+
+func TestRouterBoxWithoutNameResolver(t *testing.T) {
+	box, _ := newTestRouterBox(t, nil)
+	router, err := NewRouter(nil, Route{CIDRs: []string{"10.0.0.0/8"}, Box: box})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousHooks := logger.ReplaceHooks(make(logrus.LevelHooks))
+	defer logger.ReplaceHooks(previousHooks)
+	hook := logtest.NewLocal(logger)
+	route, err := router.Route(context.Background(), "svc.internal:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Box != nil {
+		t.Errorf("expected name to take default route, got %+v", route)
+	}
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		warned = warned || (entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "no name resolver"))
+	}
+	if !warned {
+		t.Errorf("expected a warning about box without name resolver")
+	}
+}
+
+func TestRouterStopSocksServerUnsubscribes(t *testing.T) {
+	router, err := NewRouter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		port, err := freeports.FreePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- router.StartSocksServer(port, nil)
+		}()
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		for j := 0; j < 50; j++ {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		stopTestServer(router.StopSocksServer, done)
+	}
+	if listeners := router.emitter.ListenersStopSocks(); len(listeners) != 0 {
+		t.Errorf("expected stopped socks servers to unsubscribe, got %d listeners", len(listeners))
+	}
+}
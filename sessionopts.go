@@ -3,3 +3,29 @@ package sshbox
 import "golang.org/x/crypto/ssh"
 
 type SSHSessionOptions func(session *ssh.Session) error
+
+// sessionOptions prepends session options enabled in conf to opts
+func (t *SSHBox) sessionOptions(opts []SSHSessionOptions) []SSHSessionOptions {
+	confOpts := make([]SSHSessionOptions, 0)
+	if t.config.ForwardAgent {
+		confOpts = append(confOpts, t.SessionAgentForwarding())
+	}
+	if t.config.ForwardX11 {
+		x11Forwarding := t.SessionX11Forwarding(X11Conf{})
+		// as OpenSSH does, session goes on without X11 forwarding if it fails
+		confOpts = append(confOpts, func(session *ssh.Session) error {
+			err := x11Forwarding(session)
+			if err != nil {
+				logger.Warningf("X11 forwarding disabled: %s", err)
+			}
+			return nil
+		})
+	}
+	return append(confOpts, opts...)
+}
+
+// CloseSession closes a session and releases what its session options keep on box, like the fake cookie of X11 forwarding
+func (t *SSHBox) CloseSession(session *ssh.Session) error {
+	t.releaseX11Forwarding(session)
+	return session.Close()
+}
@@ -0,0 +1,153 @@
+package sshbox
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+
+	"github.com/ArthurHlt/go-socks5"
+)
+
+// SocksAccess configures who can use socks server and reverse socks server of the box and where to,
+// for sharing it e.g. on a jump host
+type SocksAccess struct {
+	// BindAddress is the local address socks server listens on, defaults to 127.0.0.1, reverse socks server
+	// always listens on loopback of ssh server
+	BindAddress string
+	// Credentials are passwords of clients by username, clients must authenticate when it or CredentialsCallback is set
+	Credentials map[string]string
+	// CredentialsCallback validates username and password of clients not found in Credentials
+	CredentialsCallback func(user, password string) bool
+	// AllowedClients are networks clients can connect from, e.g. "10.0.0.0/8", all clients are allowed when empty.
+	// Clients of a reverse socks server are matched against their address on ssh server.
+	AllowedClients []string
+	// DestinationRules are evaluated in order against destinations before dialing, the first matching rule applies
+	DestinationRules []SocksRule
+	// DefaultDeny refuses destinations matching no rule, they are allowed otherwise
+	DefaultDeny bool
+}
+
+// SocksRule allows or denies destinations matching one of Domains or CIDRs, on one of Ports,
+// a rule with only ports matches all destinations on these ports
+type SocksRule struct {
+	// Deny refuses matching destinations, they are allowed otherwise
+	Deny bool
+	// Domains are globs matched against destination names, e.g. "*.prod.example.com"
+	Domains []string
+	// CIDRs are networks matched against destination ips, names are resolved with name resolver of the box
+	CIDRs []string
+	// Ports restricts rule to these destination ports, all ports match when empty
+	Ports []int
+}
+
+// socksAccessControl is SocksAccess with networks parsed
+type socksAccessControl struct {
+	SocksAccess
+	clients []*net.IPNet
+	rules   []Route
+}
+
+func (a SocksAccess) compile() (*socksAccessControl, error) {
+	if a.BindAddress != "" && net.ParseIP(a.BindAddress) == nil {
+		return nil, fmt.Errorf("Invalid socks bind address %s", a.BindAddress)
+	}
+	control := &socksAccessControl{SocksAccess: a}
+	for _, cidr := range a.AllowedClients {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid socks client network: %s", err)
+		}
+		control.clients = append(control.clients, ipNet)
+	}
+	for _, rule := range a.DestinationRules {
+		// routes bring the same matching on domains, networks and ports
+		route := Route{Domains: rule.Domains, CIDRs: rule.CIDRs, Ports: rule.Ports}
+		err := route.checkAndFill()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid socks destination rule: %s", err)
+		}
+		control.rules = append(control.rules, route)
+	}
+	return control, nil
+}
+
+func (c *socksAccessControl) bindAddress() string {
+	if c == nil || c.BindAddress == "" {
+		return "127.0.0.1"
+	}
+	return c.BindAddress
+}
+
+func (c *socksAccessControl) credentials() socks5.CredentialStore {
+	if c == nil || (len(c.Credentials) == 0 && c.CredentialsCallback == nil) {
+		return nil
+	}
+	return c
+}
+
+// Valid implements socks5.CredentialStore
+func (c *socksAccessControl) Valid(user, password string) bool {
+	if expected, ok := c.Credentials[user]; ok {
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	}
+	return c.CredentialsCallback != nil && c.CredentialsCallback(user, password)
+}
+
+func (c *socksAccessControl) allowClient(addr net.Addr) bool {
+	if c == nil || len(c.clients) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range c.clients {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowDestination evaluates rules against a destination name, which can be empty, its ip, which can be nil, and port
+func (c *socksAccessControl) allowDestination(name string, ip net.IP, port int) bool {
+	if c == nil {
+		return true
+	}
+	for i, route := range c.rules {
+		if !route.matchPort(port) {
+			continue
+		}
+		matched := len(route.Domains) == 0 && len(route.networks) == 0
+		if !matched && name != "" {
+			matched = route.matchDomain(name)
+		}
+		if !matched && ip != nil {
+			matched = route.matchIP(ip)
+		}
+		if matched {
+			return !c.DestinationRules[i].Deny
+		}
+	}
+	return !c.DefaultDeny
+}
+
+// socksAccessRules checks destinations of connect and bind requests after rules of socks configuration
+type socksAccessRules struct {
+	rules   socks5.RuleSet
+	control *socksAccessControl
+}
+
+func (r *socksAccessRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := r.rules.Allow(ctx, req)
+	if !ok || req.Command == socks5.AssociateCommand {
+		// destinations of UDP associations are checked on each datagram
+		return ctx, ok
+	}
+	if !r.control.allowDestination(req.DestAddr.FQDN, req.DestAddr.IP, req.DestAddr.Port) {
+		logger.Warningf("Socks connection to %s denied for client %s", req.DestAddr, req.RemoteAddr)
+		return ctx, false
+	}
+	return ctx, true
+}
@@ -0,0 +1,161 @@
+package sshbox
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/ArthurHlt/sshbox/freeports"
+)
+
+// startTestSocksServer starts socks server of box on a free port and returns its address once it accepts connections
+func startTestSocksServer(t *testing.T, box *SSHBox) string {
+	t.Helper()
+	port, err := freeports.FreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go box.StartSocksServer(port, "tcp")
+	t.Cleanup(box.StopSocksServer)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("socks server not listening on %s", addr)
+	return ""
+}
+
+// newTestTCPTarget accepts connections and writes "ok" to each of them
+func newTestTCPTarget(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func dialTestSocks(socksAddr string, auth *proxy.Auth, addr string) error {
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, auth, &net.Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// end of data from destination must reach client
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if string(reply) != "ok" {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+func newTestSocksAccessBox(t *testing.T, access SocksAccess) (*SSHBox, *testSSHServer) {
+	t.Helper()
+	server := newTestSSHServer(t)
+	box, err := NewSSHBox(server.conf(), OptSocksAccess(access))
+	if err != nil {
+		t.Fatalf("NewSSHBox: %s", err)
+	}
+	t.Cleanup(box.Close)
+	hosts := map[string][]net.IP{}
+	for _, name := range []string{"allowed.test", "open.denied.test", "web.denied.test", "unlisted.test"} {
+		hosts[name] = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	hosts["other.test"] = []net.IP{net.ParseIP("127.0.0.2")}
+	box.SetNameResolverFactory(func(sshBox *SSHBox) (NameResolver, error) {
+		return NewNameResolverDnsConf(nil, &DnsConfig{}, hosts), nil
+	})
+	return box, server
+}
+
+func TestSocksAccess(t *testing.T) {
+	box, server := newTestSocksAccessBox(t, SocksAccess{
+		Credentials: map[string]string{"alice": "secret"},
+		CredentialsCallback: func(user, password string) bool {
+			return user == "bob" && password == "token"
+		},
+		DestinationRules: []SocksRule{
+			// first matching rule applies
+			{Domains: []string{"open.denied.test"}},
+			{Deny: true, Domains: []string{"*.denied.test"}},
+			{Deny: true, CIDRs: []string{"127.0.0.2/32"}},
+			{Deny: true, Ports: []int{25}},
+			{Domains: []string{"allowed.test"}},
+		},
+		DefaultDeny: true,
+	})
+	socksAddr := startTestSocksServer(t, box)
+	port := strconv.Itoa(newTestTCPTarget(t))
+	alice := &proxy.Auth{User: "alice", Password: "secret"}
+
+	for _, auth := range []*proxy.Auth{nil, {User: "alice", Password: "wrong"}, {User: "bob", Password: "wrong"}} {
+		if err := dialTestSocks(socksAddr, auth, "allowed.test:"+port); err == nil {
+			t.Errorf("expected credentials %+v to be refused", auth)
+		}
+	}
+	for _, addr := range []string{"web.denied.test:" + port, "other.test:" + port, "allowed.test:25", "unlisted.test:" + port} {
+		if err := dialTestSocks(socksAddr, alice, addr); err == nil {
+			t.Errorf("expected destination %s to be denied", addr)
+		}
+	}
+	if dials := server.directDials(); len(dials) != 0 {
+		t.Fatalf("expected no ssh dial for refused connections, got %v", dials)
+	}
+
+	for _, dial := range []struct {
+		auth *proxy.Auth
+		addr string
+	}{
+		{alice, "allowed.test:" + port},
+		{alice, "open.denied.test:" + port},
+		{&proxy.Auth{User: "bob", Password: "token"}, "allowed.test:" + port},
+	} {
+		if err := dialTestSocks(socksAddr, dial.auth, dial.addr); err != nil {
+			t.Errorf("expected %s to be allowed: %s", dial.addr, err)
+		}
+	}
+	if dials := server.directDials(); len(dials) != 3 {
+		t.Errorf("expected allowed connections to be dialed through ssh, got %v", dials)
+	}
+}
+
+func TestSocksAccessAllowedClients(t *testing.T) {
+	box, server := newTestSocksAccessBox(t, SocksAccess{AllowedClients: []string{"10.0.0.0/8"}})
+	socksAddr := startTestSocksServer(t, box)
+	port := strconv.Itoa(newTestTCPTarget(t))
+	if err := dialTestSocks(socksAddr, nil, "allowed.test:"+port); err == nil {
+		t.Errorf("expected client from loopback to be refused")
+	}
+	if dials := server.directDials(); len(dials) != 0 {
+		t.Errorf("expected no ssh dial for a refused client, got %v", dials)
+	}
+}
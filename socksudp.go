@@ -0,0 +1,273 @@
+package sshbox
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/ArthurHlt/go-socks5"
+)
+
+const (
+	socksVersion       = 5
+	socksSucceeded     = 0
+	socksServerFailure = 1
+	socksAddrIPv4      = 1
+	socksAddrFQDN      = 3
+	socksAddrIPv6      = 4
+)
+
+// socksUDPAssociate adds UDP ASSOCIATE to socks server which does not support it. Rule check of an allowed associate
+// request is the hook serving it: an UDP relay, whose datagrams go through UDP sessions on ssh server, is replied to
+// client and runs until client closes connection or socks server is stopped. The reply socks server sends afterwards
+// is discarded.
+type socksUDPAssociate struct {
+	box   *SSHBox
+	rules socks5.RuleSet
+
+	mu       sync.Mutex
+	conns    map[string]*socksConn
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func (t *SSHBox) newSocksUDPAssociate(rules socks5.RuleSet) *socksUDPAssociate {
+	if rules == nil {
+		rules = socks5.PermitAll()
+	}
+	return &socksUDPAssociate{
+		box:     t,
+		rules:   rules,
+		conns:   make(map[string]*socksConn),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (a *socksUDPAssociate) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := a.rules.Allow(ctx, req)
+	if !ok || req.Command != socks5.AssociateCommand || req.RemoteAddr == nil {
+		return ctx, ok
+	}
+	a.mu.Lock()
+	conn := a.conns[net.JoinHostPort(req.RemoteAddr.IP.String(), strconv.Itoa(req.RemoteAddr.Port))]
+	a.mu.Unlock()
+	if conn != nil {
+		conn.serveAssociation(a.stopped)
+	}
+	return ctx, ok
+}
+
+// stop ends running associations and makes new ones end right away
+func (a *socksUDPAssociate) stop() {
+	a.stopOnce.Do(func() {
+		close(a.stopped)
+	})
+}
+
+// track wraps a connection accepted by socks server
+func (a *socksUDPAssociate) track(conn net.Conn) net.Conn {
+	sc := &socksConn{Conn: conn, associations: a}
+	a.mu.Lock()
+	a.conns[conn.RemoteAddr().String()] = sc
+	a.mu.Unlock()
+	return sc
+}
+
+type socksConn struct {
+	net.Conn
+	associations *socksUDPAssociate
+
+	mu         sync.Mutex
+	associated bool
+}
+
+// serveAssociation replies address of a new UDP relay to client and relays datagrams until client closes
+// connection or stopped is closed
+func (c *socksConn) serveAssociation(stopped <-chan struct{}) {
+	c.mu.Lock()
+	c.associated = true
+	c.mu.Unlock()
+	relay, err := c.associations.box.newSocksUDPRelay(c.Conn)
+	if err != nil {
+		logger.Warningf("Failed to start socks UDP relay: %s", err)
+		c.Conn.Write([]byte{socksVersion, socksServerFailure, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer relay.Close()
+	addr := relay.packetConn.LocalAddr().(*net.UDPAddr)
+	reply := append([]byte{socksVersion, socksSucceeded, 0}, socksAddr(addr.IP.String(), addr.Port)...)
+	_, err = c.Conn.Write(reply)
+	if err != nil {
+		return
+	}
+	clientDone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, c.Conn)
+		close(clientDone)
+	}()
+	select {
+	case <-clientDone:
+	case <-stopped:
+		c.Conn.Close()
+	}
+}
+
+// Write discards replies of socks server once an UDP association has been served on connection
+func (c *socksConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	associated := c.associated
+	c.mu.Unlock()
+	if associated {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// CloseWrite lets socks server signal end of data to client
+func (c *socksConn) CloseWrite() error {
+	if closeWriter, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closeWriter.CloseWrite()
+	}
+	return nil
+}
+
+func (c *socksConn) Close() error {
+	c.associations.mu.Lock()
+	delete(c.associations.conns, c.Conn.RemoteAddr().String())
+	c.associations.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// socksUDPRelay relays datagrams of an UDP association, a session is tracked per client address and destination
+type socksUDPRelay struct {
+	packetConn net.PacketConn
+	clientIP   net.IP
+	sessions   *udpSessions
+	access     *socksAccessControl
+}
+
+func (t *SSHBox) newSocksUDPRelay(control net.Conn) (*socksUDPRelay, error) {
+	localIP := net.IPv4(127, 0, 0, 1)
+	if addr, ok := control.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	var clientIP net.IP
+	if addr, ok := control.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+	packetConn, err := net.ListenPacket("udp", net.JoinHostPort(localIP.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	relay := &socksUDPRelay{
+		packetConn: packetConn,
+		clientIP:   clientIP,
+		access:     t.socksAccess,
+	}
+	relay.sessions = t.newUDPSessions(func(session *udpSession, datagram []byte) {
+		host, portRaw, _ := net.SplitHostPort(session.target)
+		port, _ := strconv.Atoi(portRaw)
+		header := append([]byte{0, 0, 0}, socksAddr(host, port)...)
+		_, err := packetConn.WriteTo(append(header, datagram...), session.addr)
+		if err != nil {
+			logger.Debugf("error while writing UDP datagram to %s: %s", session.addr, err)
+		}
+	})
+	go relay.serve()
+	logger.Debugf("Socks UDP relay listening on %s", packetConn.LocalAddr())
+	return relay, nil
+}
+
+func (r *socksUDPRelay) serve() {
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := r.packetConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok && r.clientIP != nil && !udpAddr.IP.Equal(r.clientIP) {
+			continue
+		}
+		target, data, ok := parseSocksUDPDatagram(buf[:n])
+		if !ok {
+			continue
+		}
+		if !r.allowTarget(target) {
+			logger.Warningf("Socks UDP datagram to %s denied for client %s", target, addr)
+			continue
+		}
+		datagram := make([]byte, len(data))
+		copy(datagram, data)
+		r.sessions.send(addr.String()+"/"+target, addr, target, datagram)
+	}
+}
+
+// allowTarget checks destination rules, names are not resolved so only domain rules apply to them
+func (r *socksUDPRelay) allowTarget(target string) bool {
+	host, portRaw, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portRaw)
+	ip := net.ParseIP(host)
+	if ip != nil {
+		return r.access.allowDestination("", ip, port)
+	}
+	return r.access.allowDestination(host, nil, port)
+}
+
+func (r *socksUDPRelay) Close() {
+	r.packetConn.Close()
+	r.sessions.Close()
+}
+
+// parseSocksUDPDatagram reads destination and data of a datagram sent to relay, fragments are not supported
+func parseSocksUDPDatagram(b []byte) (string, []byte, bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return "", nil, false
+	}
+	var host string
+	rest := b[4:]
+	switch b[3] {
+	case socksAddrIPv4:
+		if len(rest) < net.IPv4len {
+			return "", nil, false
+		}
+		host = net.IP(rest[:net.IPv4len]).String()
+		rest = rest[net.IPv4len:]
+	case socksAddrIPv6:
+		if len(rest) < net.IPv6len {
+			return "", nil, false
+		}
+		host = net.IP(rest[:net.IPv6len]).String()
+		rest = rest[net.IPv6len:]
+	case socksAddrFQDN:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return "", nil, false
+		}
+		host = string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+	default:
+		return "", nil, false
+	}
+	if len(rest) < 2 {
+		return "", nil, false
+	}
+	port := binary.BigEndian.Uint16(rest)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), rest[2:], true
+}
+
+// socksAddr formats address type, address and port as in socks replies and UDP headers
+func socksAddr(host string, port int) []byte {
+	var b []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		b = append([]byte{socksAddrFQDN, byte(len(host))}, host...)
+	case ip.To4() != nil:
+		b = append([]byte{socksAddrIPv4}, ip.To4()...)
+	default:
+		b = append([]byte{socksAddrIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,164 +16,170 @@ import (
 type SSHBoxOptions func(sshBox *SSHBox) error
 
 type SSHBox struct {
-	config              SSHConf
-	sshClient           *ssh.Client
-	sshFactory          SshClientFactory
-	socksConf           *socks5.Config
-	nameResolverFactory NameResolverFactory
-	cachedNameResolver  NameResolver
-	emitter             *Emitter
+	config               SSHConf
+	sshClient            *ssh.Client
+	clientMu             sync.RWMutex
+	closed               bool
+	reconnectPolicy      *ReconnectPolicy
+	reconnectDone        chan struct{}
+	reconnectFailed      bool
+	tunnels              []*Tunnel
+	tunnelsMu            sync.Mutex
+	sshFactory           SshClientFactoryContext
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	socksConf            *socks5.Config
+	socksAccess          *socksAccessControl
+	httpProxyCredentials socks5.CredentialStore
+	proxyAddrsMu         sync.Mutex
+	socksAddr            string
+	httpProxyAddr        string
+	pacRules             PACRules
+	nameResolverFactory  NameResolverFactory
+	cachedNameResolver   NameResolver
+	emitter              *Emitter
+	agentForwardMu       sync.Mutex
+	agentForwardClient   *ssh.Client
+	x11Mu                sync.Mutex
+	x11Client            *ssh.Client
+	x11Cookies           map[string]x11Cookie
 }
 
 func NewSSHBox(config SSHConf, opts ...SSHBoxOptions) (*SSHBox, error) {
+	return NewSSHBoxContext(context.Background(), config, opts...)
+}
+
+// NewSSHBoxContext creates an SSHBox, connecting to ssh server is aborted when ctx is done.
+// Once connected, ctx has no effect on the box.
+func NewSSHBoxContext(ctx context.Context, config SSHConf, opts ...SSHBoxOptions) (*SSHBox, error) {
 	t := &SSHBox{
 		config:              config,
-		sshFactory:          DefaultSshClientFactory,
+		sshFactory:          DefaultSshClientFactoryContext,
 		nameResolverFactory: NameResolverFactorySSH,
 		emitter:             NewEmitter(),
 	}
-	var err error
-	t.sshClient, err = t.makeSSHClient()
-	if err != nil {
-		return nil, err
-	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
 	t.socksConf = &socks5.Config{
-		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return t.sshClient.Dial(network, addr)
-		},
+		Dial: t.DialContext,
 	}
 	for _, opt := range opts {
 		err := opt(t)
 		if err != nil {
+			t.cancel()
 			return nil, err
 		}
 	}
-	return t, err
-}
-
-func (t *SSHBox) SetNameResolverFactory(nrf NameResolverFactory) {
-	t.nameResolverFactory = nrf
-}
-
-func (t *SSHBox) listenLocal(wg *sync.WaitGroup, target *TunnelTarget, startListen chan bool) error {
-	if wg != nil {
-		defer wg.Done()
-	}
-	listener, err := net.Listen(target.Network, fmt.Sprintf("127.0.0.1:%d", target.LocalPort))
+	// identities are loaded once, passphrases are not asked again on reconnections
+	var err error
+	t.config.loadedSigners, err = config.identitySigners()
 	if err != nil {
-		return errLoadErrorf("error on listening: %s", err.Error())
-	}
-
-	defer listener.Close()
-	go func() {
-		<-t.emitter.OnStopTunnels()
-		logger.Debug("Stopping tunnels cause of emitted stop tunnels message")
-		listener.Close()
-	}()
-	startListen <- true
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			return errLoadErrorf("error on accept: %s", err.Error())
-		}
-
-		go t.HandleTunnelClient(conn, target)
-	}
-	return nil // nolint
-}
-
-func (t *SSHBox) listenRLocal(wg *sync.WaitGroup, target *TunnelTarget, startListen chan bool) error {
-	if wg != nil {
-		defer wg.Done()
+		t.cancel()
+		return nil, err
 	}
-	targetAddr := fmt.Sprintf("%s:%d", target.RemoteHost, target.RemotePort)
-	listener, err := t.sshClient.Listen(target.Network, targetAddr)
+	t.sshClient, err = t.makeSSHClient(ctx)
 	if err != nil {
-		logger.Fatalln(fmt.Printf("Listen open port ON remote server error: %s", err))
+		t.cancel()
+		return nil, err
 	}
-	defer listener.Close()
+	// subscribing before returning makes sure a Close right after creation is not missed
+	stopSsh := t.emitter.OnStopSsh()
 	go func() {
-		<-t.emitter.OnStopTunnels()
-		logger.Debug("Stopping reverse tunnels cause of emitted stop tunnels message")
-		listener.Close()
+		<-stopSsh
+		logger.Debug("Stopping ssh client cause of emitted stop ssh message")
+		t.clientMu.Lock()
+		t.closed = true
+		client := t.sshClient
+		t.clientMu.Unlock()
+		t.cancel()
+		t.emitter.EmitStopSocks()
+		t.emitter.EmitStopHttpProxy()
+		t.emitter.EmitStopPac()
+		t.emitter.EmitStopTunnels()
+		client.Close()
+		t.emitter.EmitClosedSsh()
 	}()
-	startListen <- true
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-			return errLoadErrorf("error on accept: %s", err.Error())
-		}
-
-		go t.HandleRTunnelClient(conn, target)
-
-	}
+	return t, nil
+}
 
+func (t *SSHBox) SetNameResolverFactory(nrf NameResolverFactory) {
+	t.nameResolverFactory = nrf
 }
 
-func (t *SSHBox) makeSSHClient() (*ssh.Client, error) {
+func (t *SSHBox) makeSSHClient(ctx context.Context) (*ssh.Client, error) {
 
 	entry := logger.WithField("target", t.config)
 	entry.Debug("Starting ssh client ...")
-	serverConn, err := t.sshFactory(t.config)
+	serverConn, err := t.sshFactory(ctx, t.config)
 	if err != nil {
 		return nil, err
 	}
 	go t.keepalive(serverConn)
-	go func() {
-		<-t.emitter.OnStopSsh()
-		logger.Debug("Stopping ssh client cause of emitted stop ssh message")
-		t.emitter.EmitStopSocks()
-		t.emitter.EmitStopTunnels()
-		serverConn.Close()
-		t.emitter.EmitClosedSsh()
-	}()
 	return serverConn, nil
 }
 
+// SSHClient returns the current ssh client, it may change over time when a reconnect policy is set
 func (t *SSHBox) SSHClient() *ssh.Client {
+	t.clientMu.RLock()
+	defer t.clientMu.RUnlock()
 	return t.sshClient
 }
 
+// DialContext opens a connection through the ssh server, if a reconnection is in progress
+// it waits for it to finish before retrying once. Dialing is abandoned when ctx is done.
+func (t *SSHBox) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client := t.SSHClient()
+	conn, err := dialClientContext(ctx, client, network, addr)
+	if err == nil || ctx.Err() != nil || !t.waitReconnect(ctx, client) {
+		return conn, err
+	}
+	return dialClientContext(ctx, t.SSHClient(), network, addr)
+}
+
+// Dial opens a connection through the ssh server
+func (t *SSHBox) Dial(network, addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+// dialClientContext dials with ssh client which does not support context, connection
+// opened after ctx is done is closed
+func dialClientContext(ctx context.Context, client *ssh.Client, network, addr string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, err := client.Dial(network, addr)
+		result <- dialResult{conn, err}
+	}()
+	select {
+	case res := <-result:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			res := <-result
+			if res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// StartTunnels starts all tunnels and blocks until they are all stopped
 func (t *SSHBox) StartTunnels(tunnelTargets []*TunnelTarget) error {
-	wg := &sync.WaitGroup{}
-	wg.Add(len(tunnelTargets))
+	tunnels := make([]*Tunnel, 0, len(tunnelTargets))
 	for _, target := range tunnelTargets {
-		startListen := make(chan bool, 1)
-		errTunnel := make(chan error, 1)
-		logger.WithField("tunnel", target).Debug("Starting tunnel ...")
-		if !target.Reverse {
-			go func(target *TunnelTarget, startListen chan bool, wg *sync.WaitGroup) {
-				err := t.listenLocal(wg, target, startListen)
-				if err != nil {
-					errTunnel <- err
-				}
-			}(target, startListen, wg)
-		} else {
-			go func(target *TunnelTarget, startListen chan bool, wg *sync.WaitGroup) {
-				err := t.listenRLocal(wg, target, startListen)
-				if err != nil {
-					errTunnel <- err
-				}
-			}(target, startListen, wg)
-		}
-		select {
-		case err := <-errTunnel:
+		tunnel, err := t.AddTunnel(target)
+		if err != nil {
 			return err
-		case <-startListen:
-			continue
 		}
-
+		tunnels = append(tunnels, tunnel)
 	}
 	t.emitter.emitStartTunnels()
-	wg.Wait()
+	for _, tunnel := range tunnels {
+		<-tunnel.Done()
+	}
 	return nil
 }
 
@@ -199,22 +206,96 @@ func (t *SSHBox) StartSocksServer(port int, network string) error {
 	}
 
 	t.socksConf.Resolver = nameResolver
-	server, err := socks5.New(t.socksConf)
+	conf := *t.socksConf
+	t.applySocksAccess(&conf)
+	udpAssociate := t.newSocksUDPAssociate(conf.Rules)
+	conf.Rules = udpAssociate
+	server, err := socks5.New(&conf)
 	if err != nil {
 		return errLoadErrorf("new socks5 server: %s", err) // not tested
 	}
 	entry := logger.WithField("target", t.config)
-	entry.Debugf("Starting listening socks5 server on port %d and in %s", port, network)
-	listener, err := net.Listen(network, fmt.Sprintf("127.0.0.1:%d", port))
+	bindAddress := t.socksAccess.bindAddress()
+	entry.Debugf("Starting listening socks5 server on %s port %d and in %s", bindAddress, port, network)
+	listener, err := net.Listen(network, net.JoinHostPort(bindAddress, strconv.Itoa(port)))
 	if err != nil {
 		return err
 	}
+	stopSocks := t.emitter.OnStopSocks()
+	defer t.emitter.OffStopSocks(stopSocks)
 	go func() {
-		<-t.emitter.OnStopSocks()
+		<-stopSocks
 		entry.Debug("Stopping socks cause of emitted stop socks message")
 		listener.Close()
+		udpAssociate.stop()
 	}()
-	return server.Serve(listener)
+	t.setProxyAddr(&t.socksAddr, listener.Addr())
+	defer t.setProxyAddr(&t.socksAddr, nil)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !t.socksAccess.allowClient(conn.RemoteAddr()) {
+			entry.Warningf("Socks client %s denied, not in allowed clients", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go server.ServeConn(udpAssociate.track(conn))
+	}
+}
+
+// StartReverseSocksServer serves a socks5 proxy on port of ssh server, like OpenSSH -R port, connections are dialed
+// and names resolved from local machine so that remote hosts reach local network. It blocks until socks or tunnels are stopped.
+// Port only listens on loopback of ssh server but proxy is not authenticated unless credentials are set with OptSocksAccess
+// or OptSocksConf: every user and process of ssh server can then reach local network through it.
+// Destination rules of OptSocksAccess apply and its allowed clients are matched against addresses reported by ssh server.
+// When port is 0, the port allocated by server is kept after a reconnection.
+func (t *SSHBox) StartReverseSocksServer(port int) error {
+	tunnel, err := t.AddTunnel(&TunnelTarget{
+		RemotePort: port,
+		Reverse:    true,
+		Dynamic:    true,
+	})
+	if err != nil {
+		return err
+	}
+	logger.WithField("target", t.config).Debugf("Reverse socks5 server listening on %s", tunnel.Addr())
+	stopSocks := t.emitter.OnStopSocks()
+	defer t.emitter.OffStopSocks(stopSocks)
+	select {
+	case <-stopSocks:
+		tunnel.Close()
+	case <-tunnel.Done():
+	}
+	<-tunnel.Done()
+	return tunnel.Err()
+}
+
+// newReverseSocksServer makes a socks5 server dialing and resolving names locally
+func (t *SSHBox) newReverseSocksServer() (*socks5.Server, error) {
+	conf := *t.socksConf
+	conf.Dial = nil
+	conf.Resolver = nil
+	t.applySocksAccess(&conf)
+	server, err := socks5.New(&conf)
+	if err != nil {
+		return nil, errLoadErrorf("new socks5 server: %s", err)
+	}
+	return server, nil
+}
+
+// applySocksAccess makes socks configuration require credentials and check destinations of socks access
+func (t *SSHBox) applySocksAccess(conf *socks5.Config) {
+	if credentials := t.socksAccess.credentials(); credentials != nil {
+		conf.AuthMethods = []socks5.Authenticator{&socks5.UserPassAuthenticator{Credentials: credentials}}
+	}
+	if conf.Rules == nil {
+		conf.Rules = socks5.PermitAll()
+	}
+	if t.socksAccess != nil {
+		conf.Rules = &socksAccessRules{rules: conf.Rules, control: t.socksAccess}
+	}
 }
 
 func (t *SSHBox) StopSocksServer() {
@@ -233,8 +314,10 @@ func (t *SSHBox) Close() {
 
 func (t *SSHBox) HandleTunnelClient(client net.Conn, target *TunnelTarget) {
 	defer client.Close()
-	targetAddr := fmt.Sprintf("%s:%d", target.RemoteHost, target.RemotePort)
-	remoteConn, err := t.sshClient.Dial(target.Network, targetAddr)
+	targetAddr := target.remoteAddr()
+	ctx, cancel := context.WithTimeout(t.ctx, t.config.connectTimeout())
+	remoteConn, err := t.DialContext(ctx, target.remoteNetwork(), targetAddr)
+	cancel()
 	if err != nil {
 		fmt.Printf("connect to %s failed: %s\n", targetAddr, err.Error())
 		return
@@ -246,8 +329,8 @@ func (t *SSHBox) HandleTunnelClient(client net.Conn, target *TunnelTarget) {
 
 func (t *SSHBox) HandleRTunnelClient(client net.Conn, target *TunnelTarget) {
 	defer client.Close()
-	localAddr := fmt.Sprintf("127.0.0.1:%d", target.LocalPort)
-	local, err := net.Dial(target.Network, localAddr)
+	localAddr := target.localAddr()
+	local, err := net.Dial(target.localNetwork(), localAddr)
 	if err != nil {
 		fmt.Printf("connect to local %s failed: %s\n", localAddr, err.Error())
 		return
@@ -282,26 +365,73 @@ func copyData(client, server net.Conn) {
 	wg.Wait()
 }
 
-func (t SSHBox) Emitter() *Emitter {
+func (t *SSHBox) Emitter() *Emitter {
 	return t.emitter
 }
 
-func (t *SSHBox) keepalive(conn ssh.Conn) {
-	ticker := time.NewTicker(2 * time.Second)
+func (t *SSHBox) keepalive(client *ssh.Client) {
+	// connection is still watched when keepalive requests are disabled
+	var tick <-chan time.Time
+	if interval := t.config.serverAliveInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 	subStop := t.emitter.OnStopSsh()
+	defer t.emitter.OffStopSsh(subStop)
+	connDone := make(chan error, 1)
+	go func() {
+		connDone <- client.Wait()
+	}()
 	for {
 		select {
-		case <-ticker.C:
-			_, _, err := conn.SendRequest("keepalive@sshbox.com", true, nil)
+		case <-tick:
+			err := sendKeepalive(client, keepaliveTimeout)
 			if err != nil {
-				logger.Warningf("Stopping socks and tunnels because ssh interrupted: %s", err.Error())
-				t.emitter.EmitStopSocks()
-				t.emitter.EmitStopTunnels()
+				t.connectionLost(client, err)
 				return
 			}
+		case err := <-connDone:
+			if err == nil {
+				err = fmt.Errorf("connection closed")
+			}
+			t.connectionLost(client, err)
+			return
 		case <-subStop:
-			ticker.Stop()
 			return
 		}
 	}
 }
+
+func (t *SSHBox) connectionLost(client *ssh.Client, err error) {
+	t.clientMu.RLock()
+	closed := t.closed
+	current := t.sshClient == client
+	t.clientMu.RUnlock()
+	if closed || !current {
+		return
+	}
+	if t.reconnectPolicy == nil {
+		logger.Warningf("Stopping proxy servers and tunnels because ssh interrupted: %s", err.Error())
+		t.emitter.EmitStopSocks()
+		t.emitter.EmitStopHttpProxy()
+		t.emitter.EmitStopTunnels()
+		return
+	}
+	logger.Warningf("Reconnecting because ssh interrupted: %s", err.Error())
+	t.ensureReconnected(client)
+}
+
+func sendKeepalive(client *ssh.Client, timeout time.Duration) error {
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@sshbox.com", true, nil)
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no keepalive response after %s", timeout)
+	}
+}
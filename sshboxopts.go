@@ -1,16 +1,48 @@
 package sshbox
 
 import (
+	"context"
+	"net/http"
+	"time"
+
 	"github.com/ArthurHlt/go-socks5"
+	"golang.org/x/crypto/ssh"
 )
 
 func OptSSHClientFactory(factory SshClientFactory) func(box *SSHBox) error {
+	return func(box *SSHBox) error {
+		box.sshFactory = func(ctx context.Context, conf SSHConf) (*ssh.Client, error) {
+			return factory(conf)
+		}
+		return nil
+	}
+}
+
+func OptSSHClientFactoryContext(factory SshClientFactoryContext) func(box *SSHBox) error {
 	return func(box *SSHBox) error {
 		box.sshFactory = factory
 		return nil
 	}
 }
 
+// OptProxyCommand reaches ssh server through stdin and stdout of a local command, see SshClientFactoryProxyCommand
+func OptProxyCommand(command string) func(box *SSHBox) error {
+	return OptSSHClientFactoryContext(SshClientFactoryProxyCommand(command))
+}
+
+// OptWebSocket reaches ssh server through a websocket, see SshClientFactoryWebSocket
+func OptWebSocket(wsURL string, header http.Header) func(box *SSHBox) error {
+	return OptSSHClientFactoryContext(SshClientFactoryWebSocket(wsURL, header))
+}
+
+// OptConnectTimeout sets timeout for connecting to ssh server, including handshake
+func OptConnectTimeout(timeout time.Duration) func(box *SSHBox) error {
+	return func(box *SSHBox) error {
+		box.config.ConnectTimeout = timeout
+		return nil
+	}
+}
+
 func OptSocksConf(conf *socks5.Config) func(box *SSHBox) error {
 	return func(box *SSHBox) error {
 		conf.Dial = box.socksConf.Dial
@@ -19,9 +51,42 @@ func OptSocksConf(conf *socks5.Config) func(box *SSHBox) error {
 	}
 }
 
+// OptSocksAccess sets bind address, authentication and access control of socks server
+func OptSocksAccess(access SocksAccess) func(box *SSHBox) error {
+	return func(box *SSHBox) error {
+		control, err := access.compile()
+		if err != nil {
+			return err
+		}
+		box.socksAccess = control
+		return nil
+	}
+}
+
+// OptHTTPProxyCredentials makes http proxy server require basic authentication with credentials,
+// e.g. socks5.StaticCredentials
+func OptHTTPProxyCredentials(credentials socks5.CredentialStore) func(box *SSHBox) error {
+	return func(box *SSHBox) error {
+		box.httpProxyCredentials = credentials
+		return nil
+	}
+}
+
 func OptNameResolverFactory(nameResolverFactory NameResolverFactory) func(box *SSHBox) error {
 	return func(box *SSHBox) error {
 		box.nameResolverFactory = nameResolverFactory
 		return nil
 	}
 }
+
+// OptReconnect enables automatic reconnection when the ssh connection is lost
+func OptReconnect(policy ReconnectPolicy) func(box *SSHBox) error {
+	return func(box *SSHBox) error {
+		err := policy.CheckAndFill()
+		if err != nil {
+			return err
+		}
+		box.reconnectPolicy = &policy
+		return nil
+	}
+}
@@ -0,0 +1,800 @@
+package sshbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxSSHConfigDepth = 16
+
+// SSHConfig is a parsed OpenSSH client configuration, see ssh_config(5).
+// Parameters are resolved like OpenSSH does: for each parameter, the first obtained value is used.
+type SSHConfig struct {
+	files []*sshConfigFile
+}
+
+// SSHHostConfig is the result of resolving an host alias in an SSHConfig
+type SSHHostConfig struct {
+	Conf *SSHConf
+	// Gateways is the chain of jump hosts from ProxyJump to give to NewSShInGateways
+	Gateways []*SSHConf
+	// Tunnels are made from LocalForward and RemoteForward, RemoteForward without destination is a dynamic reverse tunnel
+	Tunnels []*TunnelTarget
+	// SocksPorts are made from DynamicForward
+	SocksPorts []int
+}
+
+type sshConfigFile struct {
+	path  string
+	lines []sshConfigLine
+}
+
+type sshConfigLine struct {
+	keyword  string
+	args     []string
+	path     string
+	num      int
+	included []*sshConfigFile
+}
+
+// sshConfigMultiKeywords are parameters which accumulate values instead of keeping the first one
+var sshConfigMultiKeywords = map[string]bool{
+	"identityfile":    true,
+	"certificatefile": true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"dynamicforward":  true,
+}
+
+// DefaultSSHConfig loads ~/.ssh/config and /etc/ssh/ssh_config, files which do not exist are skipped
+func DefaultSSHConfig() (*SSHConfig, error) {
+	paths := []string{expandHome("~/.ssh/config"), "/etc/ssh/ssh_config"}
+	config := &SSHConfig{}
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		file, err := readSSHConfigFile(path, filepath.Dir(path), 0)
+		if err != nil {
+			return nil, err
+		}
+		config.files = append(config.files, file)
+	}
+	return config, nil
+}
+
+// LoadSSHConfig loads ssh config files, relative Include are resolved from the directory of each file
+func LoadSSHConfig(paths ...string) (*SSHConfig, error) {
+	config := &SSHConfig{}
+	for _, path := range paths {
+		path = expandHome(path)
+		file, err := readSSHConfigFile(path, filepath.Dir(path), 0)
+		if err != nil {
+			return nil, err
+		}
+		config.files = append(config.files, file)
+	}
+	return config, nil
+}
+
+// ParseSSHConfig parses ssh config content, relative Include are resolved from baseDir
+func ParseSSHConfig(r io.Reader, baseDir string) (*SSHConfig, error) {
+	file, err := parseSSHConfigFile(r, "ssh_config", baseDir, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHConfig{files: []*sshConfigFile{file}}, nil
+}
+
+func readSSHConfigFile(path, baseDir string, depth int) (*sshConfigFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseSSHConfigFile(f, path, baseDir, depth)
+}
+
+func parseSSHConfigFile(r io.Reader, path, baseDir string, depth int) (*sshConfigFile, error) {
+	if depth > maxSSHConfigDepth {
+		return nil, fmt.Errorf("%s: too many levels of include", path)
+	}
+	file := &sshConfigFile{path: path}
+	scanner := bufio.NewScanner(r)
+	num := 0
+	for scanner.Scan() {
+		num++
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, num, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		line := sshConfigLine{keyword: keyword, args: args, path: path, num: num}
+		if keyword == "include" {
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", path, num, err)
+				}
+				for _, match := range matches {
+					included, err := readSSHConfigFile(match, baseDir, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					line.included = append(line.included, included)
+				}
+			}
+		}
+		file.lines = append(file.lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// splitSSHConfigLine returns lower cased keyword and arguments of a line, supporting
+// "keyword=value" form and double quoted arguments
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	idx := strings.IndexAny(line, " \t=")
+	if idx < 0 {
+		return strings.ToLower(line), []string{}, nil
+	}
+	keyword := strings.ToLower(line[:idx])
+	rest := strings.TrimLeft(line[idx:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	if keyword == "proxycommand" {
+		// command is given to shell as is
+		return keyword, []string{rest}, nil
+	}
+	args := make([]string, 0)
+	for rest != "" {
+		if rest[0] == '#' {
+			break
+		}
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote")
+			}
+			args = append(args, rest[1:end+1])
+			rest = strings.TrimLeft(rest[end+2:], " \t")
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+	return keyword, args, nil
+}
+
+// sshConfigValues holds parameters obtained while resolving an host
+type sshConfigValues struct {
+	alias  string
+	user   string
+	port   string
+	values map[string][]string
+	multi  map[string][][]string
+}
+
+func (v *sshConfigValues) get(keyword string) string {
+	args := v.values[keyword]
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+func (v *sshConfigValues) hostname() string {
+	hostname := v.get("hostname")
+	if hostname == "" {
+		return v.alias
+	}
+	return strings.ReplaceAll(hostname, "%h", v.alias)
+}
+
+func (v *sshConfigValues) remoteUser() string {
+	if v.user != "" {
+		return v.user
+	}
+	if user := v.get("user"); user != "" {
+		return user
+	}
+	return localUsername()
+}
+
+func (v *sshConfigValues) remotePort() string {
+	if v.port != "" {
+		return v.port
+	}
+	if port := v.get("port"); port != "" {
+		return port
+	}
+	return "22"
+}
+
+// expand replaces ${VAR} environment variables, tokens of ssh_config(5) and leading ~ in value,
+// it is only used for parameters where OpenSSH does so
+func (v *sshConfigValues) expand(value string) string {
+	home, _ := os.UserHomeDir()
+	localHost, _ := os.Hostname()
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%h", v.hostname(),
+		"%n", v.alias,
+		"%p", v.remotePort(),
+		"%r", v.remoteUser(),
+		"%u", localUsername(),
+		"%d", home,
+		"%L", strings.SplitN(localHost, ".", 2)[0],
+		"%l", localHost,
+		"%i", strconv.Itoa(os.Getuid()),
+	)
+	return expandHome(replacer.Replace(expandEnvBraces(value)))
+}
+
+// expandEnvBraces replaces ${VAR} by environment variable VAR, any other $ is kept as OpenSSH does
+func expandEnvBraces(value string) string {
+	expanded := &strings.Builder{}
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			break
+		}
+		expanded.WriteString(value[:start])
+		expanded.WriteString(os.Getenv(value[start+2 : start+end]))
+		value = value[start+end+1:]
+	}
+	expanded.WriteString(value)
+	return expanded.String()
+}
+
+func (c *SSHConfig) values(alias, user, port string) (*sshConfigValues, error) {
+	values := &sshConfigValues{
+		alias:  alias,
+		user:   user,
+		port:   port,
+		values: make(map[string][]string),
+		multi:  make(map[string][][]string),
+	}
+	for _, file := range c.files {
+		err := values.walk(file.lines)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (v *sshConfigValues) walk(lines []sshConfigLine) error {
+	active := true
+	for _, line := range lines {
+		switch line.keyword {
+		case "host":
+			active = matchPatternList(line.args, v.alias)
+		case "match":
+			var err error
+			active, err = v.match(line.args)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", line.path, line.num, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			for _, included := range line.included {
+				err := v.walk(included.lines)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			if !active {
+				continue
+			}
+			if sshConfigMultiKeywords[line.keyword] {
+				v.multi[line.keyword] = append(v.multi[line.keyword], line.args)
+				continue
+			}
+			if _, ok := v.values[line.keyword]; !ok {
+				v.values[line.keyword] = line.args
+			}
+		}
+	}
+	return nil
+}
+
+// match evaluates criteria of a Match line, all criteria must match
+func (v *sshConfigValues) match(criteria []string) (bool, error) {
+	if len(criteria) == 0 {
+		return false, fmt.Errorf("missing Match criteria")
+	}
+	result := true
+	for i := 0; i < len(criteria); i++ {
+		criterion := strings.ToLower(criteria[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+		var matched bool
+		switch criterion {
+		case "all":
+			matched = true
+		case "canonical":
+			matched = false
+		case "final":
+			matched = true
+		case "host", "originalhost", "user", "localuser", "exec", "localnetwork", "tagged":
+			if i+1 >= len(criteria) {
+				return false, fmt.Errorf("missing argument for Match %s", criterion)
+			}
+			i++
+			patterns := strings.Split(criteria[i], ",")
+			switch criterion {
+			case "host":
+				matched = matchPatternList(patterns, v.hostname())
+			case "originalhost":
+				matched = matchPatternList(patterns, v.alias)
+			case "user":
+				matched = matchPatternList(patterns, v.remoteUser())
+			case "localuser":
+				matched = matchPatternList(patterns, localUsername())
+			default:
+				logger.Warningf("Match %s is not supported, considered as not matching", criterion)
+				matched = false
+			}
+		default:
+			return false, fmt.Errorf("unsupported Match criteria %s", criterion)
+		}
+		if matched == negate {
+			result = false
+		}
+	}
+	return result, nil
+}
+
+// matchPatternList matches value against patterns, a negated pattern (!pattern) which matches refuses the value
+func matchPatternList(patterns []string, value string) bool {
+	value = strings.ToLower(value)
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(pattern[1:], value) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(pattern, value) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern matches value against a pattern with * and ? wildcards
+func matchPattern(pattern, value string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(value); i >= 0; i-- {
+				if matchPattern(pattern[1:], value[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+		default:
+			if len(value) == 0 || pattern[0] != value[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		value = value[1:]
+	}
+	return len(value) == 0
+}
+
+// Resolve builds ssh configuration, gateways and forwards for an host alias as OpenSSH would
+func (c *SSHConfig) Resolve(alias string) (*SSHHostConfig, error) {
+	user, host, port, err := splitUserHostPort(alias)
+	if err != nil {
+		return nil, err
+	}
+	return c.resolve(host, user, port, 0)
+}
+
+func (c *SSHConfig) resolve(alias, user, port string, depth int) (*SSHHostConfig, error) {
+	if depth > maxSSHConfigDepth {
+		return nil, fmt.Errorf("too many levels of ProxyJump for %s", alias)
+	}
+	values, err := c.values(alias, user, port)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := values.sshConf()
+	if err != nil {
+		return nil, err
+	}
+	hostConfig := &SSHHostConfig{
+		Conf:     conf,
+		Gateways: make([]*SSHConf, 0),
+	}
+	proxyJump := values.get("proxyjump")
+	if proxyJump != "" && strings.ToLower(proxyJump) != "none" {
+		for _, jump := range strings.Split(proxyJump, ",") {
+			jumpUser, jumpHost, jumpPort, err := splitUserHostPort(jump)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ProxyJump for %s: %s", alias, err)
+			}
+			jumpConfig, err := c.resolve(jumpHost, jumpUser, jumpPort, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			// only the first jump host may have its own jump hosts, as OpenSSH does
+			if len(hostConfig.Gateways) == 0 {
+				hostConfig.Gateways = append(hostConfig.Gateways, jumpConfig.Gateways...)
+			}
+			hostConfig.Gateways = append(hostConfig.Gateways, jumpConfig.Conf)
+		}
+	}
+	hostConfig.Tunnels, err = values.tunnels()
+	if err != nil {
+		return nil, err
+	}
+	hostConfig.SocksPorts, err = values.socksPorts()
+	if err != nil {
+		return nil, err
+	}
+	return hostConfig, nil
+}
+
+func (v *sshConfigValues) sshConf() (*SSHConf, error) {
+	conf := &SSHConf{
+		Host:         net.JoinHostPort(v.hostname(), v.remotePort()),
+		User:         v.remoteUser(),
+		HostKeyAlias: v.get("hostkeyalias"),
+	}
+	for _, args := range v.multi["identityfile"] {
+		if len(args) == 0 || strings.ToLower(args[0]) == "none" {
+			continue
+		}
+		path := v.expand(args[0])
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if conf.PrivateKey != "" {
+			conf.Identities = append(conf.Identities, Identity{Path: path})
+			continue
+		}
+		conf.PrivateKey = path
+	}
+	for _, args := range v.multi["certificatefile"] {
+		if len(args) == 0 {
+			continue
+		}
+		if conf.Certificate != "" {
+			logger.Warningf("Only one CertificateFile is supported, %s is ignored in favor of %s", v.expand(args[0]), conf.Certificate)
+			continue
+		}
+		conf.Certificate = v.expand(args[0])
+	}
+
+	// ProxyJump and ProxyCommand are exclusive, ProxyJump is made with gateways
+	proxyCommand := v.get("proxycommand")
+	if proxyCommand != "" && strings.ToLower(proxyCommand) != "none" && v.get("proxyjump") == "" {
+		conf.ProxyCommand = proxyCommand
+	}
+
+	switch agent := v.get("identityagent"); agent {
+	case "":
+	case "none":
+		conf.NoSSHAgent = true
+	case "SSH_AUTH_SOCK":
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		conf.SSHAuthSock = &sock
+	default:
+		sock := v.expand(agent)
+		conf.SSHAuthSock = &sock
+	}
+
+	conf.ForwardAgent = strings.ToLower(v.get("forwardagent")) == "yes"
+	conf.ForwardX11 = strings.ToLower(v.get("forwardx11")) == "yes"
+
+	switch strings.ToLower(v.get("stricthostkeychecking")) {
+	case "no", "off":
+		conf.HostKeyCheck = HostKeyCheckOff
+	case "accept-new":
+		conf.HostKeyCheck = HostKeyCheckAcceptNew
+	default:
+		conf.HostKeyCheck = HostKeyCheckStrict
+	}
+	userKnownHosts := v.values["userknownhostsfile"]
+	if len(userKnownHosts) == 0 {
+		userKnownHosts = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+	}
+	globalKnownHosts := v.values["globalknownhostsfile"]
+	if len(globalKnownHosts) == 0 {
+		globalKnownHosts = []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"}
+	}
+	for _, file := range userKnownHosts {
+		if strings.ToLower(file) == "none" {
+			continue
+		}
+		conf.KnownHostsFiles = append(conf.KnownHostsFiles, v.expand(file))
+	}
+	for _, file := range globalKnownHosts {
+		if strings.ToLower(file) == "none" {
+			continue
+		}
+		conf.KnownHostsFiles = append(conf.KnownHostsFiles, file)
+	}
+
+	if timeout := v.get("connecttimeout"); timeout != "" && strings.ToLower(timeout) != "none" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnectTimeout %s", timeout)
+		}
+		conf.ConnectTimeout = time.Duration(seconds) * time.Second
+	}
+	if interval := v.get("serveraliveinterval"); interval != "" {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerAliveInterval %s", interval)
+		}
+		conf.ServerAliveInterval = time.Duration(seconds) * time.Second
+		// as in OpenSSH, 0 disables keepalive requests
+		if seconds == 0 {
+			conf.ServerAliveInterval = -1
+		}
+	}
+	conf.Ciphers = v.algorithmList("ciphers", cipherAlgorithms)
+	conf.KeyExchanges = v.algorithmList("kexalgorithms", kexAlgorithms)
+	conf.MACs = v.algorithmList("macs", macAlgorithms)
+	conf.HostKeyAlgorithms = v.algorithmList("hostkeyalgorithms", hostKeyAlgorithms)
+
+	err := conf.CheckAndFill()
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// algorithmList reads a comma separated list of algorithms, leading +, ^ and - respectively append, prepend
+// and remove algorithms from defaults. Algorithms which are not supported are skipped.
+func (v *sshConfigValues) algorithmList(keyword string, kind algorithmKind) []string {
+	value := v.get(keyword)
+	if value == "" {
+		return nil
+	}
+	prefix := value[0]
+	if prefix == '+' || prefix == '^' || prefix == '-' {
+		value = value[1:]
+	}
+	names := strings.Split(value, ",")
+	if prefix == '-' {
+		algos := make([]string, 0)
+		for _, algo := range kind.presets[AlgorithmsDefault] {
+			if !matchPatternList(names, algo) {
+				algos = append(algos, algo)
+			}
+		}
+		return algos
+	}
+	algos := make([]string, 0, len(names))
+	for _, name := range names {
+		if !containsString(kind.presets[AlgorithmsCompat], name) {
+			logger.Debugf("Unsupported %s algorithm %s, skipping", kind.name, name)
+			continue
+		}
+		algos = append(algos, name)
+	}
+	switch prefix {
+	case '+':
+		return append([]string{AlgorithmsDefault}, algos...)
+	case '^':
+		return append(algos, AlgorithmsDefault)
+	}
+	if len(algos) == 0 {
+		return nil
+	}
+	return algos
+}
+
+func (v *sshConfigValues) tunnels() ([]*TunnelTarget, error) {
+	tunnels := make([]*TunnelTarget, 0)
+	for _, args := range v.multi["localforward"] {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("invalid LocalForward %s", strings.Join(args, " "))
+		}
+		target := &TunnelTarget{Network: "tcp"}
+		if isSocketPath(args[0]) {
+			target.LocalSocket = expandHome(args[0])
+		} else {
+			_, localPort, err := splitForwardListen(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid LocalForward %s: %s", strings.Join(args, " "), err)
+			}
+			target.LocalPort = localPort
+		}
+		if isSocketPath(args[1]) {
+			target.RemoteSocket = args[1]
+			tunnels = append(tunnels, target)
+			continue
+		}
+		remoteHost, remotePortRaw, err := net.SplitHostPort(args[1])
+		if err != nil {
+			logger.Warningf("LocalForward %s is not supported, skipping", strings.Join(args, " "))
+			continue
+		}
+		target.RemoteHost = remoteHost
+		target.RemotePort, err = strconv.Atoi(remotePortRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LocalForward %s: %s", strings.Join(args, " "), err)
+		}
+		tunnels = append(tunnels, target)
+	}
+	for _, args := range v.multi["remoteforward"] {
+		if len(args) == 1 && !isSocketPath(args[0]) {
+			_, remotePort, err := splitForwardListen(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid RemoteForward %s: %s", args[0], err)
+			}
+			tunnels = append(tunnels, &TunnelTarget{
+				Network:    "tcp",
+				RemotePort: remotePort,
+				Reverse:    true,
+				Dynamic:    true,
+			})
+			continue
+		}
+		if len(args) != 2 {
+			logger.Warningf("RemoteForward %s is not supported, skipping", strings.Join(args, " "))
+			continue
+		}
+		target := &TunnelTarget{Network: "tcp", Reverse: true}
+		if isSocketPath(args[0]) {
+			target.RemoteSocket = args[0]
+		} else {
+			_, remotePort, err := splitForwardListen(args[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid RemoteForward %s: %s", strings.Join(args, " "), err)
+			}
+			target.RemotePort = remotePort
+		}
+		if isSocketPath(args[1]) {
+			target.LocalSocket = expandHome(args[1])
+			tunnels = append(tunnels, target)
+			continue
+		}
+		localHost, localPortRaw, err := net.SplitHostPort(args[1])
+		if err != nil || !isLoopback(localHost) {
+			logger.Warningf("RemoteForward %s is not supported, skipping", strings.Join(args, " "))
+			continue
+		}
+		target.LocalPort, err = strconv.Atoi(localPortRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RemoteForward %s: %s", strings.Join(args, " "), err)
+		}
+		tunnels = append(tunnels, target)
+	}
+	return tunnels, nil
+}
+
+func (v *sshConfigValues) socksPorts() ([]int, error) {
+	ports := make([]int, 0)
+	for _, args := range v.multi["dynamicforward"] {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid DynamicForward %s", strings.Join(args, " "))
+		}
+		_, port, err := splitForwardListen(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid DynamicForward %s: %s", args[0], err)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// splitForwardListen parses [bind_address:]port of forward parameters
+func splitForwardListen(listen string) (string, int, error) {
+	bindAddr := ""
+	portRaw := listen
+	if idx := strings.LastIndex(listen, ":"); idx >= 0 {
+		bindAddr = strings.Trim(listen[:idx], "[]")
+		portRaw = listen[idx+1:]
+	}
+	port, err := strconv.Atoi(portRaw)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %s", portRaw)
+	}
+	if bindAddr != "" && bindAddr != "localhost" && !isLoopback(bindAddr) {
+		logger.Warningf("Bind address %s is not supported, listening on loopback", bindAddr)
+	}
+	return bindAddr, port, nil
+}
+
+// isSocketPath tells if a forward parameter is a unix socket path, as OpenSSH does paths contain a slash
+func isSocketPath(arg string) bool {
+	return strings.Contains(arg, "/")
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// splitUserHostPort parses [user@]host[:port] and ssh://[user@]host[:port] destinations
+func splitUserHostPort(dest string) (user, host, port string, err error) {
+	if strings.HasPrefix(dest, "ssh://") {
+		u, err := url.Parse(dest)
+		if err != nil {
+			return "", "", "", err
+		}
+		return u.User.Username(), u.Hostname(), u.Port(), nil
+	}
+	if idx := strings.LastIndex(dest, "@"); idx >= 0 {
+		user = dest[:idx]
+		dest = dest[idx+1:]
+	}
+	host = dest
+	if h, p, err := net.SplitHostPort(dest); err == nil {
+		host, port = h, p
+	}
+	if host == "" {
+		return "", "", "", fmt.Errorf("empty host in %s", dest)
+	}
+	return user, host, port, nil
+}
+
+func localUsername() string {
+	user, err := osuser.Current()
+	if err != nil {
+		return ""
+	}
+	return user.Username
+}
+
+// Connect connects to the host through its gateways
+func (h *SSHHostConfig) Connect() (*SShInGateways, error) {
+	return h.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the host through its gateways, connecting is aborted when ctx is done
+func (h *SSHHostConfig) ConnectContext(ctx context.Context) (*SShInGateways, error) {
+	return NewSShInGatewaysContext(ctx, h.Conf, h.Gateways)
+}
@@ -0,0 +1,252 @@
+package sshbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func parseTestSSHConfig(t *testing.T, content string) *SSHConfig {
+	t.Helper()
+	config, err := ParseSSHConfig(strings.NewReader(content), t.TempDir())
+	if err != nil {
+		t.Fatalf("ParseSSHConfig: %s", err)
+	}
+	return config
+}
+
+func resolveTestSSHConfig(t *testing.T, config *SSHConfig, alias string) *SSHHostConfig {
+	t.Helper()
+	hostConfig, err := config.Resolve(alias)
+	if err != nil {
+		t.Fatalf("Resolve %s: %s", alias, err)
+	}
+	return hostConfig
+}
+
+func TestSSHConfigHostAndFirstValueWins(t *testing.T) {
+	config := parseTestSSHConfig(t, `
+Host web-* !web-admin
+  HostName %h.example.com
+  User deploy
+
+Host web-1
+  User other
+  Port 2222
+
+Host *
+  User fallback
+  Port 22
+`)
+	tests := []struct {
+		alias string
+		host  string
+		user  string
+	}{
+		{alias: "web-1", host: "web-1.example.com:2222", user: "deploy"},
+		{alias: "web-admin", host: "web-admin:22", user: "fallback"},
+		{alias: "root@web-2:2200", host: "web-2.example.com:2200", user: "root"},
+	}
+	for _, test := range tests {
+		hostConfig := resolveTestSSHConfig(t, config, test.alias)
+		if hostConfig.Conf.Host != test.host {
+			t.Errorf("%s: expected host %s, got %s", test.alias, test.host, hostConfig.Conf.Host)
+		}
+		if hostConfig.Conf.User != test.user {
+			t.Errorf("%s: expected user %s, got %s", test.alias, test.user, hostConfig.Conf.User)
+		}
+	}
+}
+
+func TestSSHConfigMatch(t *testing.T) {
+	config := parseTestSSHConfig(t, `
+Host db
+  HostName db.internal
+
+Match host *.internal user admin
+  Port 2022
+
+Match host *.internal
+  Port 2023
+
+Match exec "true"
+  User exec
+`)
+	hostConfig := resolveTestSSHConfig(t, config, "admin@db")
+	if hostConfig.Conf.Host != "db.internal:2022" {
+		t.Errorf("expected host db.internal:2022, got %s", hostConfig.Conf.Host)
+	}
+	hostConfig = resolveTestSSHConfig(t, config, "bob@db")
+	if hostConfig.Conf.Host != "db.internal:2023" {
+		t.Errorf("expected host db.internal:2023, got %s", hostConfig.Conf.Host)
+	}
+	if hostConfig.Conf.User != "bob" {
+		t.Errorf("Match exec must not match, got user %s", hostConfig.Conf.User)
+	}
+
+	invalid := parseTestSSHConfig(t, "Match host\n")
+	_, err := invalid.Resolve("db")
+	if err == nil {
+		t.Errorf("expected an error for Match without argument")
+	}
+}
+
+func TestSSHConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "conf.d", "a.conf"), []byte("Host included\n  HostName included.example.com\n  Port 2200\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "config"), []byte("Include conf.d/*.conf\n\nHost included\n  Port 22\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadSSHConfig(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("LoadSSHConfig: %s", err)
+	}
+	hostConfig := resolveTestSSHConfig(t, config, "included")
+	if hostConfig.Conf.Host != "included.example.com:2200" {
+		t.Errorf("expected included values to come first, got host %s", hostConfig.Conf.Host)
+	}
+}
+
+func TestSSHConfigProxyJump(t *testing.T) {
+	config := parseTestSSHConfig(t, `
+Host target
+  ProxyJump jump2,carol@jump3:2222
+
+Host jump2
+  ProxyJump jump1
+
+Host jump1 jump2 jump3
+  HostName %h.example.com
+  User alice
+`)
+	hostConfig := resolveTestSSHConfig(t, config, "target")
+	expected := []string{"alice@jump1.example.com:22", "alice@jump2.example.com:22", "carol@jump3.example.com:2222"}
+	if len(hostConfig.Gateways) != len(expected) {
+		t.Fatalf("expected %d gateways, got %d", len(expected), len(hostConfig.Gateways))
+	}
+	for i, gateway := range hostConfig.Gateways {
+		if got := gateway.User + "@" + gateway.Host; got != expected[i] {
+			t.Errorf("gateway %d: expected %s, got %s", i, expected[i], got)
+		}
+	}
+
+	loop := parseTestSSHConfig(t, "Host loop\n  ProxyJump loop\n")
+	_, err := loop.Resolve("loop")
+	if err == nil {
+		t.Errorf("expected an error for ProxyJump loop")
+	}
+}
+
+func TestSSHConfigForwards(t *testing.T) {
+	config := parseTestSSHConfig(t, `
+Host fwd
+  LocalForward 8080 localhost:80
+  LocalForward 127.0.0.1:5432 /var/run/postgresql/.s.PGSQL.5432
+  RemoteForward 9000 localhost:3000
+  RemoteForward 1080
+  DynamicForward 1081
+`)
+	hostConfig := resolveTestSSHConfig(t, config, "fwd")
+	if len(hostConfig.Tunnels) != 4 {
+		t.Fatalf("expected 4 tunnels, got %d", len(hostConfig.Tunnels))
+	}
+	local := hostConfig.Tunnels[0]
+	if local.Reverse || local.LocalPort != 8080 || local.RemoteHost != "localhost" || local.RemotePort != 80 {
+		t.Errorf("unexpected LocalForward tunnel %+v", local)
+	}
+	socket := hostConfig.Tunnels[1]
+	if socket.LocalPort != 5432 || socket.RemoteSocket != "/var/run/postgresql/.s.PGSQL.5432" {
+		t.Errorf("unexpected LocalForward to socket tunnel %+v", socket)
+	}
+	remote := hostConfig.Tunnels[2]
+	if !remote.Reverse || remote.RemotePort != 9000 || remote.LocalPort != 3000 {
+		t.Errorf("unexpected RemoteForward tunnel %+v", remote)
+	}
+	dynamic := hostConfig.Tunnels[3]
+	if !dynamic.Reverse || !dynamic.Dynamic || dynamic.RemotePort != 1080 {
+		t.Errorf("unexpected dynamic RemoteForward tunnel %+v", dynamic)
+	}
+	if len(hostConfig.SocksPorts) != 1 || hostConfig.SocksPorts[0] != 1081 {
+		t.Errorf("expected socks port 1081, got %v", hostConfig.SocksPorts)
+	}
+
+	invalid := parseTestSSHConfig(t, "Host fwd\n  LocalForward 8080\n")
+	_, err := invalid.Resolve("fwd")
+	if err == nil {
+		t.Errorf("expected an error for LocalForward without destination")
+	}
+}
+
+func TestSSHConfigExpandEnv(t *testing.T) {
+	t.Setenv("SSHBOX_TEST_DIR", "/tmp/sshbox")
+	config := parseTestSSHConfig(t, `
+Host env
+  CertificateFile ${SSHBOX_TEST_DIR}/id_$HOME-cert.pub
+  UserKnownHostsFile ${SSHBOX_TEST_DIR}/known_hosts_%h
+  GlobalKnownHostsFile /etc/ssh/known_${SSHBOX_TEST_DIR}
+`)
+	hostConfig := resolveTestSSHConfig(t, config, "env")
+	if hostConfig.Conf.Certificate != "/tmp/sshbox/id_$HOME-cert.pub" {
+		t.Errorf("expected only ${VAR} to be expanded, got %s", hostConfig.Conf.Certificate)
+	}
+	expected := []string{"/tmp/sshbox/known_hosts_env", "/etc/ssh/known_${SSHBOX_TEST_DIR}"}
+	if strings.Join(hostConfig.Conf.KnownHostsFiles, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected known hosts files %v, got %v", expected, hostConfig.Conf.KnownHostsFiles)
+	}
+}
+
+func TestSSHConfigServerAliveInterval(t *testing.T) {
+	config := parseTestSSHConfig(t, `
+Host alive
+  ServerAliveInterval 30
+Host off
+  ServerAliveInterval 0
+`)
+	alive := resolveTestSSHConfig(t, config, "alive").Conf
+	if alive.serverAliveInterval() != 30*time.Second {
+		t.Errorf("expected keepalive every 30s, got %s", alive.serverAliveInterval())
+	}
+	off := resolveTestSSHConfig(t, config, "off").Conf
+	if off.serverAliveInterval() != 0 {
+		t.Errorf("expected ServerAliveInterval 0 to disable keepalive, got %s", off.serverAliveInterval())
+	}
+	unset := resolveTestSSHConfig(t, config, "unset").Conf
+	if unset.serverAliveInterval() != 2*time.Second {
+		t.Errorf("expected default keepalive interval, got %s", unset.serverAliveInterval())
+	}
+}
+
+func TestSSHConfigMultipleCertificateFiles(t *testing.T) {
+	config := parseTestSSHConfig(t, `
+Host certs
+  CertificateFile /tmp/first-cert.pub
+  CertificateFile /tmp/second-cert.pub
+`)
+	previousHooks := logger.ReplaceHooks(make(logrus.LevelHooks))
+	defer logger.ReplaceHooks(previousHooks)
+	hook := logtest.NewLocal(logger)
+	hostConfig := resolveTestSSHConfig(t, config, "certs")
+	if hostConfig.Conf.Certificate != "/tmp/first-cert.pub" {
+		t.Errorf("expected first certificate to be used, got %s", hostConfig.Conf.Certificate)
+	}
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		warned = warned || (entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "/tmp/second-cert.pub"))
+	}
+	if !warned {
+		t.Errorf("expected a warning about ignored certificate")
+	}
+}
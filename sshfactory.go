@@ -1,6 +1,7 @@
 package sshbox
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -10,7 +11,6 @@ import (
 	"net"
 	"os"
 	"strings"
-	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -24,48 +24,158 @@ const (
 
 type SshClientFactory func(conf SSHConf) (*ssh.Client, error)
 
+// SshClientFactoryContext is a SshClientFactory which aborts dialing and handshake when context is done
+type SshClientFactoryContext func(ctx context.Context, conf SSHConf) (*ssh.Client, error)
+
+// Dialer opens the connection on which ssh is established
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
 func DefaultSshClientFactory(conf SSHConf) (*ssh.Client, error) {
-	var hostKeyCallback ssh.HostKeyCallback = ssh.InsecureIgnoreHostKey()
-	if conf.HostKeyFingerprint != "" {
-		hostKeyCallback = fingerprintCallback(conf.HostKeyFingerprint)
+	return DefaultSshClientFactoryContext(context.Background(), conf)
+}
+
+// DefaultSshClientFactoryContext dials ssh server with tcp from BindAddress or BindInterface if set,
+// through upstream Proxy if set, or through ProxyCommand if set
+func DefaultSshClientFactoryContext(ctx context.Context, conf SSHConf) (*ssh.Client, error) {
+	if conf.ProxyCommand != "" {
+		return SshClientFactoryProxyCommand(conf.ProxyCommand)(ctx, conf)
+	}
+	dialer, err := conf.dialer()
+	if err != nil {
+		return nil, err
+	}
+	return NewSSHClientWithDialer(ctx, conf, dialer)
+}
+
+// dialer returns a tcp dialer from BindAddress or BindInterface going through upstream Proxy if set
+func (c SSHConf) dialer() (Dialer, error) {
+	localAddr, err := c.localAddr()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{}
+	if localAddr != nil {
+		dialer.LocalAddr = localAddr
+	}
+	return c.proxyDialer(dialer)
+}
+
+// SshClientFactoryFromDialer makes a factory establishing ssh on connections opened by dialer
+func SshClientFactoryFromDialer(dialer Dialer) SshClientFactoryContext {
+	return func(ctx context.Context, conf SSHConf) (*ssh.Client, error) {
+		return NewSSHClientWithDialer(ctx, conf, dialer)
+	}
+}
+
+// NewSSHClientWithDialer establishes ssh on a connection to conf host opened by dialer,
+// ConnectTimeout applies to both dialing and handshake
+func NewSSHClientWithDialer(ctx context.Context, conf SSHConf, dialer Dialer) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, conf.connectTimeout())
+	defer cancel()
+	conn, err := dialer(ctx, "tcp", conf.hostPort())
+	if err != nil {
+		return nil, err
+	}
+	return NewSSHClientFromConn(ctx, conf, conn)
+}
+
+// NewSSHClientFromConn establishes ssh on conn, conn is closed if handshake fails or context is done before its end
+func NewSSHClientFromConn(ctx context.Context, conf SSHConf, conn net.Conn) (*ssh.Client, error) {
+	var hostKeyErr error
+	clientConfig, err := makeSSHClientConfig(conf, &hostKeyErr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// closing connection aborts handshake, deadlines are not supported by every connection (e.g. ssh channels)
+	handshakeDone := make(chan struct{})
+	abortErr := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			abortErr <- ctx.Err()
+		case <-handshakeDone:
+			abortErr <- nil
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, conf.hostPort(), clientConfig)
+	close(handshakeDone)
+	if ctxErr := <-abortErr; ctxErr != nil {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, fmt.Errorf("ssh handshake with %s aborted: %w", conf.hostPort(), ctxErr)
+	}
+	if err != nil {
+		conn.Close()
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+func makeSSHClientConfig(conf SSHConf, hostKeyErr *error) (*ssh.ClientConfig, error) {
+	hostKeyCallback, hostKeyAlgorithms, err := makeHostKeyCallback(conf, hostKeyErr)
+	if err != nil {
+		return nil, err
+	}
+	algos, err := conf.algorithms()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := conf.userCertificate()
+	if err != nil {
+		return nil, err
 	}
 	authMethods := make([]ssh.AuthMethod, 0)
 	sshAuthSock := ""
 	if conf.SSHAuthSock != nil && !conf.NoSSHAgent {
 		sshAuthSock = *conf.SSHAuthSock
 	}
-	if sshAgent, err := net.Dial("unix", sshAuthSock); err == nil {
-		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+	var agentSigners func() ([]ssh.Signer, error)
+	if conf.Agent != nil && !conf.NoSSHAgent {
+		agentSigners = conf.Agent.Signers
+	} else if sshAgent, err := net.Dial("unix", sshAuthSock); err == nil {
+		agentSigners = agent.NewClient(sshAgent).Signers
+	}
+	if agentSigners != nil {
+		authMethods = append(authMethods, ssh.PublicKeysCallback(certSignersCallback(cert, agentSigners)))
 	}
 	if conf.Password != "" {
 		authMethods = append(authMethods, ssh.Password(conf.Password))
 	}
+	if handlers := conf.challengeHandlers(); len(handlers) > 0 {
+		authMethods = append(authMethods, ssh.KeyboardInteractive(keyboardInteractive(conf, handlers)))
+	}
 
-	if conf.PrivateKey != "" {
-		pubKeys, err := NewPublicKeysFromFile(conf.PrivateKey, conf.Passphrase)
+	identitySigners, err := conf.identitySigners()
+	if err != nil {
+		return nil, err
+	}
+	warnUnusedCertificate(cert, identitySigners, agentSigners)
+	if len(identitySigners) > 0 {
+		signers, err := withCertSigners(cert, identitySigners)
 		if err != nil {
 			return nil, err
 		}
-		authMethods = append(authMethods, ssh.PublicKeys(pubKeys.Signer))
-	}
-
-	host, port, err := net.SplitHostPort(conf.Host)
-	if err != nil {
-		host = conf.Host
-		port = "22"
+		authMethods = append(authMethods, ssh.PublicKeys(signers...))
 	}
 
-	serverConn, err := ssh.Dial("tcp", host+":"+port, &ssh.ClientConfig{
-		User:            conf.User,
-		Auth:            authMethods,
-		HostKeyCallback: hostKeyCallback,
-		Timeout:         15 * time.Second,
-	})
-
-	if err != nil {
-		return nil, err
-	}
-	return serverConn, nil
+	return &ssh.ClientConfig{
+		Config: ssh.Config{
+			Ciphers:      algos.ciphers,
+			KeyExchanges: algos.keyExchanges,
+			MACs:         algos.macs,
+		},
+		User:              conf.User,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: restrictAlgorithms(algos.hostKeyAlgorithms, hostKeyAlgorithms),
+		Timeout:           conf.connectTimeout(),
+	}, nil
 }
 
 func md5Fingerprint(key ssh.PublicKey) string {
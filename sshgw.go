@@ -1,6 +1,9 @@
 package sshbox
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 type SShInGateways struct {
 	gateways   *Gateways
@@ -8,17 +11,19 @@ type SShInGateways struct {
 }
 
 func NewSShInGateways(sshConf *SSHConf, gatewaysConf []*SSHConf) (*SShInGateways, error) {
-	var gateways *Gateways
-	if len(gatewaysConf) > 0 {
-		gateways = NewGateways(gatewaysConf)
-		sshUri, err := gateways.RunGateways(sshConf.Host)
-		if err != nil {
-			return nil, fmt.Errorf("failed to run gateways: %s", err)
-		}
-		sshConf.Host = sshUri
+	return NewSShInGatewaysContext(context.Background(), sshConf, gatewaysConf)
+}
+
+// NewSShInGatewaysContext connects through gateways, connecting is aborted when ctx is done
+func NewSShInGatewaysContext(ctx context.Context, sshConf *SSHConf, gatewaysConf []*SSHConf) (*SShInGateways, error) {
+	gateways := NewGateways(gatewaysConf)
+	factory, err := gateways.Chain(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run gateways: %s", err)
 	}
-	sb, err := NewSSHBox(*sshConf)
+	sb, err := NewSSHBoxContext(ctx, *sshConf, OptSSHClientFactoryContext(factory))
 	if err != nil {
+		gateways.Close()
 		return nil, fmt.Errorf("failed to create sshbox: %s", err)
 	}
 	return &SShInGateways{
@@ -31,9 +36,8 @@ func (S *SShInGateways) SSHBox() *SSHBox {
 	return S.currentBox
 }
 
+// Close closes the ssh box then gateways from the nearest to the farthest
 func (S *SShInGateways) Close() {
-	if S.gateways != nil {
-		S.gateways.Close()
-	}
 	S.currentBox.Close()
+	S.gateways.Close()
 }
@@ -0,0 +1,261 @@
+package sshbox
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testSSHUser     = "sshbox"
+	testSSHPassword = "sshbox-password"
+)
+
+// testSSHServer is a minimal ssh server accepting password authentication, direct-tcpip channels
+// and sessions running commands with sh whose x11-req requests are recorded
+type testSSHServer struct {
+	listener    net.Listener
+	config      *ssh.ServerConfig
+	x11Requests chan testX11Request
+	mu          sync.Mutex
+	conns       []net.Conn
+	sshConns    []*ssh.ServerConn
+	commands    []string
+	dials       []string
+}
+
+// testX11Request is the payload of an x11-req request
+type testX11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() != testSSHUser || string(password) != testSSHPassword {
+				return nil, fmt.Errorf("invalid credentials")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{listener: listener, config: config, x11Requests: make(chan testX11Request, 10)}
+	t.Cleanup(s.close)
+	go s.serve()
+	return s
+}
+
+func (s *testSSHServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// conf returns a SSHConf authenticating on server
+func (s *testSSHServer) conf() SSHConf {
+	noAgent := ""
+	return SSHConf{
+		Host:        s.addr(),
+		User:        testSSHUser,
+		Password:    testSSHPassword,
+		SSHAuthSock: &noAgent,
+	}
+}
+
+// lastConn returns the last established ssh connection, to open channels to client
+func (s *testSSHServer) lastConn() *ssh.ServerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sshConns) == 0 {
+		return nil
+	}
+	return s.sshConns[len(s.sshConns)-1]
+}
+
+// directDials returns destinations of direct-tcpip channels opened by clients
+func (s *testSSHServer) directDials() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.dials...)
+}
+
+// execCommands returns commands run by sessions
+func (s *testSSHServer) execCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *testSSHServer) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *testSSHServer) handle(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.sshConns = append(s.sshConns, sshConn)
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			go s.handleDirectTCPIP(newChannel)
+		case "session":
+			go s.handleSession(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *testSSHServer) handleSession(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "x11-req":
+			var x11Request testX11Request
+			err := ssh.Unmarshal(req.Payload, &x11Request)
+			if err == nil {
+				s.x11Requests <- x11Request
+			}
+			req.Reply(err == nil, nil)
+		case "exec":
+			var payload struct{ Command string }
+			err := ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(err == nil, nil)
+			if err != nil {
+				continue
+			}
+			s.mu.Lock()
+			s.commands = append(s.commands, payload.Command)
+			s.mu.Unlock()
+			go runTestCommand(channel, payload.Command)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// runTestCommand runs command with sh on channel and sends its exit status
+func runTestCommand(channel ssh.Channel, command string) {
+	defer channel.Close()
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+	status := 0
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status = exitErr.ExitCode()
+	} else if err != nil {
+		status = 127
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+func (s *testSSHServer) handleDirectTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	err := ssh.Unmarshal(newChannel.ExtraData(), &payload)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port))
+	s.mu.Lock()
+	s.dials = append(s.dials, addr)
+	s.mu.Unlock()
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		target.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	testPipe(channel, target)
+}
+
+// testPipe copies data in both directions until one side is done
+func testPipe(a, b io.ReadWriteCloser) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// stopTestServer calls stop until server returns on done, a server subscribes to stop events only once listening
+func stopTestServer(stop func(), done <-chan error) error {
+	for {
+		stop()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package sshbox
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ArthurHlt/go-socks5"
+	"golang.org/x/crypto/ssh"
+)
+
+// TunnelStats holds counters of a running tunnel, bytes are counted from the side accepting connections,
+// connections are UDP sessions for an udp tunnel
+type TunnelStats struct {
+	ActiveConns   int64
+	TotalConns    int64
+	BytesReceived int64
+	BytesSent     int64
+}
+
+// Tunnel is a handle on a tunnel or a reverse tunnel started with SSHBox.AddTunnel
+type Tunnel struct {
+	box        *SSHBox
+	target     *TunnelTarget
+	socks      *socks5.Server
+	mu         sync.Mutex
+	listener   net.Listener
+	packetConn net.PacketConn
+	closed     bool
+	done       chan struct{}
+	err        error
+
+	activeConns   int64
+	totalConns    int64
+	bytesReceived int64
+	bytesSent     int64
+}
+
+// AddTunnel starts listening for the given target and returns a handle on it without blocking.
+// The tunnel is also closed when tunnels are stopped on the box.
+func (t *SSHBox) AddTunnel(target *TunnelTarget) (*Tunnel, error) {
+	err := target.CheckAndFill()
+	if err != nil {
+		return nil, err
+	}
+	logger.WithField("tunnel", target).Debug("Starting tunnel ...")
+	tunnel := &Tunnel{
+		box:    t,
+		target: target,
+		done:   make(chan struct{}),
+	}
+	if target.Dynamic {
+		tunnel.socks, err = t.newReverseSocksServer()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var client *ssh.Client
+	if isUDPNetwork(target.Network) {
+		if target.Reverse || target.LocalSocket != "" || target.RemoteSocket != "" {
+			return nil, errLoadErrorf("udp tunnels can only forward a local port to a remote host and port")
+		}
+		tunnel.packetConn, err = net.ListenPacket(target.Network, target.localAddr())
+		if err != nil {
+			return nil, errLoadErrorf("error on listening: %s", err.Error())
+		}
+	} else if target.Reverse {
+		client = t.SSHClient()
+		tunnel.listener, err = client.Listen(target.remoteNetwork(), target.remoteAddr())
+		if err != nil {
+			return nil, errLoadErrorf("listen open port on remote server error: %s", err.Error())
+		}
+		// port allocated by server is kept so that the same one is listened again after a reconnection
+		if addr, ok := tunnel.listener.Addr().(*net.TCPAddr); ok && target.RemoteSocket == "" && target.RemotePort == 0 {
+			target.RemotePort = addr.Port
+		}
+	} else if target.LocalSocket != "" {
+		tunnel.listener, err = listenUnixSocket(target.LocalSocket, target.SocketMode)
+		if err != nil {
+			return nil, errLoadErrorf("error on listening: %s", err.Error())
+		}
+	} else {
+		tunnel.listener, err = net.Listen(target.Network, target.localAddr())
+		if err != nil {
+			return nil, errLoadErrorf("error on listening: %s", err.Error())
+		}
+	}
+
+	t.tunnelsMu.Lock()
+	t.tunnels = append(t.tunnels, tunnel)
+	t.tunnelsMu.Unlock()
+
+	subStop := t.emitter.OnStopTunnels()
+	go func() {
+		select {
+		case <-subStop:
+			logger.WithField("tunnel", target).Debug("Stopping tunnel cause of emitted stop tunnels message")
+			tunnel.Close()
+		case <-tunnel.done:
+		}
+		t.emitter.OffStopTunnels(subStop)
+	}()
+
+	go func() {
+		defer close(tunnel.done)
+		defer t.removeTunnel(tunnel)
+		var err error
+		if tunnel.packetConn != nil {
+			err = tunnel.servePacket(tunnel.packetConn)
+		} else if target.Reverse {
+			err = tunnel.serveReverse(client)
+		} else {
+			err = tunnel.accept(tunnel.listener)
+		}
+		tunnel.mu.Lock()
+		if !tunnel.closed {
+			tunnel.err = err
+		}
+		tunnel.mu.Unlock()
+	}()
+	return tunnel, nil
+}
+
+// Tunnels returns the tunnels currently running on the box
+func (t *SSHBox) Tunnels() []*Tunnel {
+	t.tunnelsMu.Lock()
+	defer t.tunnelsMu.Unlock()
+	tunnels := make([]*Tunnel, len(t.tunnels))
+	copy(tunnels, t.tunnels)
+	return tunnels
+}
+
+func (t *SSHBox) removeTunnel(tunnel *Tunnel) {
+	t.tunnelsMu.Lock()
+	defer t.tunnelsMu.Unlock()
+	for i, tun := range t.tunnels {
+		if tun == tunnel {
+			t.tunnels = append(t.tunnels[:i], t.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+// Addr returns the address the tunnel is listening on, it is a remote address for a reverse tunnel,
+// a *net.UnixAddr when listening on a unix socket and a *net.UDPAddr for an udp tunnel
+func (tun *Tunnel) Addr() net.Addr {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	if tun.packetConn != nil {
+		return tun.packetConn.LocalAddr()
+	}
+	return tun.listener.Addr()
+}
+
+// Target returns the target the tunnel was started with
+func (tun *Tunnel) Target() TunnelTarget {
+	return *tun.target
+}
+
+// Stats returns a snapshot of the tunnel counters
+func (tun *Tunnel) Stats() TunnelStats {
+	return TunnelStats{
+		ActiveConns:   atomic.LoadInt64(&tun.activeConns),
+		TotalConns:    atomic.LoadInt64(&tun.totalConns),
+		BytesReceived: atomic.LoadInt64(&tun.bytesReceived),
+		BytesSent:     atomic.LoadInt64(&tun.bytesSent),
+	}
+}
+
+// Done returns a channel closed when the tunnel stopped listening
+func (tun *Tunnel) Done() <-chan struct{} {
+	return tun.done
+}
+
+// Err returns the error which made the tunnel stop, it is nil when the tunnel has been closed
+func (tun *Tunnel) Err() error {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	return tun.err
+}
+
+// Close stops listening, connections already accepted are left running until they end
+func (tun *Tunnel) Close() error {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	if tun.closed {
+		return nil
+	}
+	tun.closed = true
+	if tun.packetConn != nil {
+		return tun.packetConn.Close()
+	}
+	return tun.listener.Close()
+}
+
+func (tun *Tunnel) String() string {
+	return tun.target.String()
+}
+
+func (tun *Tunnel) isClosed() bool {
+	tun.mu.Lock()
+	defer tun.mu.Unlock()
+	return tun.closed
+}
+
+// serveReverse accepts connections on the remote listener and registers it again on the new ssh client
+// after a reconnection
+func (tun *Tunnel) serveReverse(client *ssh.Client) error {
+	for {
+		err := tun.accept(tun.listener)
+		if tun.isClosed() || !tun.box.ensureReconnected(client) {
+			return err
+		}
+		logger.WithField("tunnel", tun.target).Debug("Re-registering reverse tunnel after reconnection")
+		for {
+			client = tun.box.SSHClient()
+			listener, err := client.Listen(tun.target.remoteNetwork(), tun.target.remoteAddr())
+			if err == nil {
+				tun.mu.Lock()
+				if tun.closed {
+					tun.mu.Unlock()
+					listener.Close()
+					return nil
+				}
+				tun.listener = listener
+				tun.mu.Unlock()
+				break
+			}
+			if tun.isClosed() || !tun.box.ensureReconnected(client) {
+				return errLoadErrorf("listen open port on remote server error: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (tun *Tunnel) accept(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return errLoadErrorf("error on accept: %s", err.Error())
+		}
+
+		go tun.handle(conn)
+	}
+}
+
+func (tun *Tunnel) handle(conn net.Conn) {
+	atomic.AddInt64(&tun.totalConns, 1)
+	atomic.AddInt64(&tun.activeConns, 1)
+	defer atomic.AddInt64(&tun.activeConns, -1)
+	conn = &statsConn{Conn: conn, tunnel: tun}
+	if tun.socks != nil {
+		if !tun.box.socksAccess.allowClient(conn.RemoteAddr()) {
+			logger.WithField("tunnel", tun.target).Warningf("Reverse socks client %s denied, not in allowed clients", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		tun.socks.ServeConn(conn)
+		return
+	}
+	if tun.target.Reverse {
+		tun.box.HandleRTunnelClient(conn, tun.target)
+		return
+	}
+	tun.box.HandleTunnelClient(conn, tun.target)
+}
+
+type statsConn struct {
+	net.Conn
+	tunnel *Tunnel
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.tunnel.bytesReceived, int64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.tunnel.bytesSent, int64(n))
+	return n, err
+}
@@ -2,6 +2,8 @@ package sshbox
 
 import (
 	"fmt"
+	"os"
+
 	"github.com/ArthurHlt/sshbox/freeports"
 )
 
@@ -13,33 +15,100 @@ type TunnelTarget struct {
 	RemotePort int
 	LocalPort  int
 	Reverse    bool
+	// LocalSocket is a local unix socket path used in place of LocalPort
+	LocalSocket string
+	// RemoteSocket is a unix socket path on ssh server (e.g. /var/run/docker.sock) used in place of RemoteHost and RemotePort
+	RemoteSocket string
+	// SocketMode is permission of local unix socket file created by a tunnel, defaults to 0600
+	SocketMode os.FileMode
+	// Dynamic serves a socks5 proxy on RemotePort of ssh server whose connections are dialed from local machine,
+	// like OpenSSH -R without destination, it requires Reverse. RemotePort is allocated by server when not set and
+	// is then set to the allocated port, which is asked again after a reconnection.
+	// Every user of ssh server can use the proxy unless it requires authentication.
+	Dynamic bool
 }
 
 func (c *TunnelTarget) CheckAndFill() error {
 	var err error
-	if c.LocalPort <= 0 {
-		c.LocalPort, err = freeports.FreePort()
-		if err != nil {
-			return err
+	if c.Dynamic {
+		if !c.Reverse || c.LocalSocket != "" || isUDPNetwork(c.Network) {
+			return fmt.Errorf("dynamic tunnel must be a reverse tcp tunnel without local socket")
+		}
+		if c.Network == "" {
+			c.Network = "tcp"
+		}
+		if c.RemoteSocket == "" {
+			c.RemoteHost = "127.0.0.1"
+		}
+		return nil
+	}
+	if c.LocalSocket == "" {
+		if c.LocalPort <= 0 {
+			c.LocalPort, err = freeports.FreePort()
+			if err != nil {
+				return err
+			}
+		} else {
+			freeports.RegisterPort(c.LocalPort)
 		}
-	} else {
-		freeports.RegisterPort(c.LocalPort)
 	}
 	if c.Network == "" {
 		c.Network = "tcp"
 	}
-	if c.Reverse {
+	if c.SocketMode == 0 {
+		c.SocketMode = 0600
+	}
+	if c.Reverse && c.RemoteSocket == "" {
 		c.RemoteHost = "127.0.0.1"
 		if c.RemotePort <= 0 {
 			c.RemotePort = c.LocalPort
 		}
+		if c.RemotePort <= 0 {
+			return fmt.Errorf("RemotePort must be set for a reverse tunnel to a local unix socket")
+		}
 	}
 	return nil
 }
 
+func (c TunnelTarget) localNetwork() string {
+	if c.LocalSocket != "" {
+		return "unix"
+	}
+	return c.Network
+}
+
+func (c TunnelTarget) localAddr() string {
+	if c.LocalSocket != "" {
+		return c.LocalSocket
+	}
+	return fmt.Sprintf("127.0.0.1:%d", c.LocalPort)
+}
+
+func (c TunnelTarget) remoteNetwork() string {
+	if c.RemoteSocket != "" {
+		return "unix"
+	}
+	return c.Network
+}
+
+func (c TunnelTarget) remoteAddr() string {
+	if c.RemoteSocket != "" {
+		return c.RemoteSocket
+	}
+	return fmt.Sprintf("%s:%d", c.RemoteHost, c.RemotePort)
+}
+
 func (c TunnelTarget) String() string {
+	local := fmt.Sprintf("%s://localhost:%d", c.Network, c.LocalPort)
+	if c.Dynamic {
+		local = "socks5 dialing from localhost"
+	}
+	if c.LocalSocket != "" {
+		local = "unix://" + c.LocalSocket
+	}
+	remote := fmt.Sprintf("%s://%s", c.remoteNetwork(), c.remoteAddr())
 	if !c.Reverse {
-		return fmt.Sprintf("%s://localhost:%d -> %s://%s:%d", c.Network, c.LocalPort, c.Network, c.RemoteHost, c.RemotePort)
+		return local + " -> " + remote
 	}
-	return fmt.Sprintf("%s://%s:%d -> %s://localhost:%d", c.Network, c.RemoteHost, c.RemotePort, c.Network, c.LocalPort)
+	return remote + " -> " + local
 }
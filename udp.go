@@ -0,0 +1,555 @@
+package sshbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// UDPHelper is a command run on ssh server to relay datagrams to targets, as ssh has no udp channel.
+// A helper is run once per udp tunnel or socks UDP association and relays datagrams of all their sessions, so that they
+// don't use up sessions allowed by ssh server (MaxSessions of OpenSSH). It reads frames from stdin and writes frames to
+// stdout, each made of a type on 1 byte, a session id on 4 bytes and data length on 2 bytes, big endian, followed by data.
+// Type 0 opens a session to target host:port given as data, type 1 is a datagram of a session and type 2 closes a session,
+// helper sends type 2 when a session fails.
+type UDPHelper struct {
+	// Command is run by the shell of ssh server, it can be a helper uploaded beforehand (e.g. "~/bin/udp-relay"),
+	// %h and %p are replaced by quoted host and port of target for an unframed command
+	Command string
+	// Unframed must be set when command relays raw datagrams to a single target (e.g. socat), it is then run for each
+	// session and datagram boundaries are only kept at low rate
+	Unframed bool
+}
+
+const udpRelayPython = `import socket,struct,sys,threading
+i=sys.stdin.buffer
+o=sys.stdout.buffer
+l=threading.Lock()
+c={}
+def w(t,n,d):
+    with l:
+        o.write(struct.pack(">BIH",t,n,len(d))+d)
+        o.flush()
+def r(n,s):
+    while True:
+        try:
+            d=s.recv(65535)
+        except OSError:
+            break
+        if c.get(n) is not s:
+            break
+        w(1,n,d)
+    if c.get(n) is s:
+        del c[n]
+        w(2,n,b"")
+    s.close()
+while True:
+    h=i.read(7)
+    if len(h)<7:
+        break
+    t,n,m=struct.unpack(">BIH",h)
+    d=i.read(m)
+    if t==0:
+        try:
+            x,y=d.decode().rsplit(":",1)
+            a=socket.getaddrinfo(x.strip("[]"),int(y),0,socket.SOCK_DGRAM)[0]
+            s=socket.socket(a[0],a[1])
+            s.connect(a[4])
+        except (OSError,ValueError) as e:
+            sys.stderr.write("%s: %s\n"%(d.decode(errors="replace"),e))
+            w(2,n,b"")
+            continue
+        c[n]=s
+        threading.Thread(target=r,args=(n,s),daemon=True).start()
+    elif t==1:
+        s=c.get(n)
+        try:
+            s and s.send(d)
+        except OSError:
+            pass
+    else:
+        s=c.pop(n,None)
+        try:
+            s and s.shutdown(socket.SHUT_RDWR)
+        except OSError:
+            pass
+`
+
+var (
+	// UDPHelperPython relays datagrams with python3 found on most servers, it is the default helper
+	UDPHelperPython = UDPHelper{Command: "python3 -c '" + udpRelayPython + "'"}
+	// UDPHelperSocat relays datagrams with socat which does not keep datagram boundaries
+	UDPHelperSocat = UDPHelper{Command: "socat STDIO UDP:%h:%p", Unframed: true}
+)
+
+const udpSessionQueueSize = 64
+
+// frame types of UDPHelper protocol
+const (
+	udpFrameOpen     = 0
+	udpFrameDatagram = 1
+	udpFrameClose    = 2
+	udpFrameHeader   = 7
+)
+
+func isUDPNetwork(network string) bool {
+	return strings.HasPrefix(network, "udp")
+}
+
+func (h UDPHelper) command(target string) (string, error) {
+	command := h.Command
+	if command == "" {
+		command = UDPHelperPython.Command
+	}
+	if !h.Unframed {
+		return command, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	command = strings.ReplaceAll(command, "%h", shellQuote(host))
+	return strings.ReplaceAll(command, "%p", shellQuote(port)), nil
+}
+
+// shellQuote quotes s for a posix shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// udpSession relays datagrams between a local peer and a target through a helper on ssh server
+type udpSession struct {
+	// id identifies session in frames exchanged with helper
+	id uint32
+	// addr is the local peer of session
+	addr net.Addr
+	// target is host:port datagrams are relayed to
+	target     string
+	queue      chan []byte
+	lastActive int64
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// udpSessions tracks UDP sessions by key, sessions not used for idleTimeout are closed
+type udpSessions struct {
+	box         *SSHBox
+	helper      UDPHelper
+	idleTimeout time.Duration
+	// reply is called with each datagram received from target of a session
+	reply func(session *udpSession, datagram []byte)
+	// opened and closed are called when a session starts and ends, they can be nil
+	opened func()
+	closed func()
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	nextID   uint32
+	done     chan struct{}
+
+	processMu sync.Mutex
+	process   *udpHelperProcess
+}
+
+func (t *SSHBox) newUDPSessions(reply func(session *udpSession, datagram []byte)) *udpSessions {
+	sessions := &udpSessions{
+		box:         t,
+		helper:      t.config.UDPHelper,
+		idleTimeout: t.config.udpIdleTimeout(),
+		reply:       reply,
+		sessions:    make(map[string]*udpSession),
+		done:        make(chan struct{}),
+	}
+	go sessions.expire()
+	return sessions
+}
+
+// send relays datagram from addr to target, session is opened if none exists for key.
+// Datagram is dropped if session is too slow, as UDP does.
+func (s *udpSessions) send(key string, addr net.Addr, target string, datagram []byte) {
+	if len(datagram) > 0xffff {
+		return
+	}
+	s.mu.Lock()
+	session, ok := s.sessions[key]
+	if !ok {
+		select {
+		case <-s.done:
+			s.mu.Unlock()
+			return
+		default:
+		}
+		s.nextID++
+		session = &udpSession{
+			id:     s.nextID,
+			addr:   addr,
+			target: target,
+			queue:  make(chan []byte, udpSessionQueueSize),
+			done:   make(chan struct{}),
+		}
+		session.touch()
+		s.sessions[key] = session
+		go s.run(key, session)
+	}
+	s.mu.Unlock()
+	session.touch()
+	select {
+	case session.queue <- datagram:
+	default:
+		logger.WithField("udp_target", target).Debug("UDP session queue is full, dropping datagram")
+	}
+}
+
+func (s *udpSessions) run(key string, session *udpSession) {
+	if s.opened != nil {
+		s.opened()
+	}
+	defer func() {
+		s.mu.Lock()
+		if s.sessions[key] == session {
+			delete(s.sessions, key)
+		}
+		s.mu.Unlock()
+		session.close()
+		if s.closed != nil {
+			s.closed()
+		}
+	}()
+	entry := logger.WithField("udp_target", session.target)
+	if s.helper.Unframed {
+		s.runUnframed(session, entry)
+		return
+	}
+	process, err := s.helperProcess()
+	if err != nil {
+		entry.Warningf("Failed to start UDP helper: %s", err)
+		return
+	}
+	err = process.open(session)
+	if err != nil {
+		entry.Debugf("Failed to open UDP session on helper: %s", err)
+		return
+	}
+	defer process.close(session)
+	entry.Debug("UDP session started")
+	for {
+		select {
+		case <-session.done:
+			entry.Debug("UDP session ended")
+			return
+		case <-process.done:
+			entry.Debug("UDP session ended with helper")
+			return
+		case datagram := <-session.queue:
+			err := process.write(udpFrameDatagram, session.id, datagram)
+			if err != nil {
+				entry.Debugf("Failed to write to UDP helper: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// runUnframed relays datagrams of session through its own helper
+func (s *udpSessions) runUnframed(session *udpSession, entry *logrus.Entry) {
+	command, err := s.helper.command(session.target)
+	if err != nil {
+		entry.Warningf("Invalid UDP target: %s", err)
+		return
+	}
+	sshSession, stdin, stdout, err := s.startHelper(command, entry)
+	if err != nil {
+		entry.Warningf("Failed to start UDP helper: %s", err)
+		return
+	}
+	defer sshSession.Close()
+	entry.Debug("UDP session started")
+
+	go s.readUnframed(session, stdout)
+	go func() {
+		sshSession.Wait()
+		session.close()
+	}()
+	for {
+		select {
+		case <-session.done:
+			entry.Debug("UDP session ended")
+			return
+		case datagram := <-session.queue:
+			_, err := stdin.Write(datagram)
+			if err != nil {
+				entry.Debugf("Failed to write to UDP helper: %s", err)
+				return
+			}
+		}
+	}
+}
+
+func (s *udpSessions) readUnframed(session *udpSession, stdout io.Reader) {
+	defer session.close()
+	buf := make([]byte, 0xffff)
+	for {
+		n, err := stdout.Read(buf)
+		if err != nil {
+			return
+		}
+		session.touch()
+		s.reply(session, buf[:n])
+	}
+}
+
+// startHelper runs command on ssh server with pipes to its stdin and stdout, its stderr is logged
+func (s *udpSessions) startHelper(command string, entry *logrus.Entry) (*ssh.Session, io.WriteCloser, io.Reader, error) {
+	sshSession, err := s.box.SSHClient().NewSession()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdin, err := sshSession.StdinPipe()
+	if err != nil {
+		sshSession.Close()
+		return nil, nil, nil, err
+	}
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		sshSession.Close()
+		return nil, nil, nil, err
+	}
+	sshSession.Stderr = &udpHelperLogger{entry: entry}
+	err = sshSession.Start(command)
+	if err != nil {
+		sshSession.Close()
+		return nil, nil, nil, err
+	}
+	return sshSession, stdin, stdout, nil
+}
+
+// helperProcess returns the helper relaying datagrams of all sessions, it is started again if it has ended
+func (s *udpSessions) helperProcess() (*udpHelperProcess, error) {
+	s.processMu.Lock()
+	defer s.processMu.Unlock()
+	if s.process != nil {
+		select {
+		case <-s.process.done:
+		default:
+			return s.process, nil
+		}
+	}
+	select {
+	case <-s.done:
+		return nil, fmt.Errorf("UDP sessions are closed")
+	default:
+	}
+	command, err := s.helper.command("")
+	if err != nil {
+		return nil, err
+	}
+	sshSession, stdin, stdout, err := s.startHelper(command, logrus.NewEntry(logger))
+	if err != nil {
+		return nil, err
+	}
+	process := &udpHelperProcess{
+		sshSession: sshSession,
+		stdin:      stdin,
+		sessions:   make(map[uint32]*udpSession),
+		done:       make(chan struct{}),
+	}
+	go s.readFrames(process, stdout)
+	go func() {
+		sshSession.Wait()
+		process.stop()
+	}()
+	s.process = process
+	return process, nil
+}
+
+// readFrames dispatches datagrams written by helper to their session
+func (s *udpSessions) readFrames(process *udpHelperProcess, stdout io.Reader) {
+	defer process.stop()
+	reader := bufio.NewReaderSize(stdout, udpFrameHeader+0xffff)
+	header := make([]byte, udpFrameHeader)
+	buf := make([]byte, 0xffff)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return
+		}
+		data := buf[:binary.BigEndian.Uint16(header[5:])]
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return
+		}
+		session := process.session(binary.BigEndian.Uint32(header[1:5]))
+		if session == nil {
+			continue
+		}
+		switch header[0] {
+		case udpFrameDatagram:
+			session.touch()
+			s.reply(session, data)
+		case udpFrameClose:
+			session.close()
+		}
+	}
+}
+
+// udpHelperProcess is a running helper relaying datagrams of sessions
+type udpHelperProcess struct {
+	sshSession *ssh.Session
+	stdin      io.WriteCloser
+	writeMu    sync.Mutex
+
+	mu       sync.Mutex
+	sessions map[uint32]*udpSession
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (p *udpHelperProcess) write(frameType byte, id uint32, data []byte) error {
+	frame := make([]byte, udpFrameHeader, udpFrameHeader+len(data))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(data)))
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	_, err := p.stdin.Write(append(frame, data...))
+	return err
+}
+
+func (p *udpHelperProcess) open(session *udpSession) error {
+	p.mu.Lock()
+	p.sessions[session.id] = session
+	p.mu.Unlock()
+	return p.write(udpFrameOpen, session.id, []byte(session.target))
+}
+
+// close tells helper to close session, error is ignored as helper may have ended
+func (p *udpHelperProcess) close(session *udpSession) {
+	p.mu.Lock()
+	delete(p.sessions, session.id)
+	p.mu.Unlock()
+	p.write(udpFrameClose, session.id, nil)
+}
+
+func (p *udpHelperProcess) session(id uint32) *udpSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sessions[id]
+}
+
+func (p *udpHelperProcess) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+		p.sshSession.Close()
+	})
+}
+
+func (s *udpSessions) expire() {
+	interval := s.idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		deadline := time.Now().Add(-s.idleTimeout).UnixNano()
+		s.mu.Lock()
+		for key, session := range s.sessions {
+			if atomic.LoadInt64(&session.lastActive) < deadline {
+				logger.WithField("udp_target", session.target).Debug("Closing idle UDP session")
+				delete(s.sessions, key)
+				session.close()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close closes all sessions and helper
+func (s *udpSessions) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	close(s.done)
+	for key, session := range s.sessions {
+		delete(s.sessions, key)
+		session.close()
+	}
+	s.mu.Unlock()
+	s.processMu.Lock()
+	defer s.processMu.Unlock()
+	if s.process != nil {
+		s.process.stop()
+	}
+}
+
+// udpHelperLogger logs stderr of UDP helper
+type udpHelperLogger struct {
+	entry *logrus.Entry
+}
+
+func (l *udpHelperLogger) Write(p []byte) (int, error) {
+	l.entry.Warningf("UDP helper: %s", strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// servePacket relays datagrams received on local UDP socket, a session is tracked per source address
+func (tun *Tunnel) servePacket(packetConn net.PacketConn) error {
+	target := tun.target.remoteAddr()
+	sessions := tun.box.newUDPSessions(func(session *udpSession, datagram []byte) {
+		n, err := packetConn.WriteTo(datagram, session.addr)
+		atomic.AddInt64(&tun.bytesSent, int64(n))
+		if err != nil {
+			logger.Debugf("error while writing UDP datagram to %s: %s", session.addr, err)
+		}
+	})
+	sessions.opened = func() {
+		atomic.AddInt64(&tun.totalConns, 1)
+		atomic.AddInt64(&tun.activeConns, 1)
+	}
+	sessions.closed = func() {
+		atomic.AddInt64(&tun.activeConns, -1)
+	}
+	defer sessions.Close()
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			return errLoadErrorf("error on read: %s", err.Error())
+		}
+		atomic.AddInt64(&tun.bytesReceived, int64(n))
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		sessions.send(addr.String(), addr, target, datagram)
+	}
+}
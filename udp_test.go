@@ -0,0 +1,187 @@
+package sshbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ArthurHlt/go-socks5"
+)
+
+// newTestUDPEcho replies to each datagram with "echo:" followed by datagram
+func newTestUDPEcho(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packetConn.Close() })
+	go func() {
+		buf := make([]byte, 0xffff)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packetConn.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+	return packetConn.LocalAddr().(*net.UDPAddr)
+}
+
+func newTestUDPBox(t *testing.T) (*SSHBox, *testSSHServer) {
+	t.Helper()
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed by UDP helper")
+	}
+	server := newTestSSHServer(t)
+	box, err := NewSSHBox(server.conf())
+	if err != nil {
+		t.Fatalf("NewSSHBox: %s", err)
+	}
+	t.Cleanup(box.Close)
+	return box, server
+}
+
+func readTestDatagram(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 0xffff)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read datagram: %s", err)
+	}
+	return buf[:n]
+}
+
+func TestUDPTunnel(t *testing.T) {
+	box, server := newTestUDPBox(t)
+	echoAddr := newTestUDPEcho(t)
+	tunnel, err := box.AddTunnel(&TunnelTarget{Network: "udp", RemoteHost: "127.0.0.1", RemotePort: echoAddr.Port})
+	if err != nil {
+		t.Fatalf("AddTunnel: %s", err)
+	}
+
+	// more source ports than sessions allowed by default by OpenSSH
+	for i := 0; i < 12; i++ {
+		conn, err := net.Dial("udp", tunnel.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		message := fmt.Sprintf("hello %d", i)
+		_, err = conn.Write([]byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply := readTestDatagram(t, conn); string(reply) != "echo:"+message {
+			t.Fatalf("expected echo of %q, got %q", message, reply)
+		}
+	}
+	if stats := tunnel.Stats(); stats.TotalConns != 12 {
+		t.Errorf("expected 12 UDP sessions, got %d", stats.TotalConns)
+	}
+	if commands := server.execCommands(); len(commands) != 1 {
+		t.Errorf("expected a single helper for all sessions, got %d", len(commands))
+	}
+}
+
+func TestUDPTunnelSessionClosedByHelper(t *testing.T) {
+	box, _ := newTestUDPBox(t)
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.LocalAddr().(*net.UDPAddr).Port
+	closed.Close()
+	tunnel, err := box.AddTunnel(&TunnelTarget{Network: "udp", RemoteHost: "127.0.0.1", RemotePort: closedPort})
+	if err != nil {
+		t.Fatalf("AddTunnel: %s", err)
+	}
+	conn, err := net.Dial("udp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// helper gets connection refused on its socket and closes session well before idle timeout
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.Write([]byte("ping"))
+		time.Sleep(50 * time.Millisecond)
+		stats := tunnel.Stats()
+		if stats.TotalConns > 0 && stats.ActiveConns == 0 {
+			return
+		}
+	}
+	t.Errorf("expected session to be closed by helper, got %+v", tunnel.Stats())
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	box, _ := newTestUDPBox(t)
+	box.SetNameResolverFactory(func(sshBox *SSHBox) (NameResolver, error) {
+		return nil, nil
+	})
+	echoAddr := newTestUDPEcho(t)
+	control, err := net.Dial("tcp", startTestSocksServer(t, box))
+	if err != nil {
+		t.Fatalf("dial socks server: %s", err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = control.Write([]byte{socksVersion, 1, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	_, err = io.ReadFull(control, method)
+	if err != nil || method[1] != 0 {
+		t.Fatalf("expected no authentication method, got %v %v", method, err)
+	}
+	_, err = control.Write([]byte{socksVersion, socks5.AssociateCommand, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(control, reply)
+	if err != nil {
+		t.Fatalf("read associate reply: %s", err)
+	}
+	if reply[0] != socksVersion || reply[1] != socksSucceeded || reply[3] != socksAddrIPv4 {
+		t.Fatalf("expected associate to succeed with an IPv4 relay address, got %v", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+
+	relay, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	header := append([]byte{0, 0, 0}, socksAddr(echoAddr.IP.String(), echoAddr.Port)...)
+	_, err = relay.Write(append(header, "hello"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram := readTestDatagram(t, relay)
+	if !bytes.HasPrefix(datagram, header) || string(datagram[len(header):]) != "echo:hello" {
+		t.Errorf("expected echo from %s, got %q", echoAddr, datagram)
+	}
+
+	// association ends with socks server
+	box.StopSocksServer()
+	rest, err := io.ReadAll(control)
+	if err != nil || len(rest) != 0 {
+		t.Errorf("expected control connection to be closed without further reply, got %v %v", rest, err)
+	}
+	relay.Write(append(header, "hello"...))
+	relay.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := relay.Read(make([]byte, 0xffff)); err == nil {
+		t.Errorf("expected relay to be closed, got %d bytes", n)
+	}
+}
@@ -0,0 +1,43 @@
+package sshbox
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// listenUnixSocket listens on a unix socket at path with given permission, a socket file left by a process
+// which is not running anymore is removed first. Socket is never more permissive than mode.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	return createUnixSocket(path, mode)
+}
+
+// removeStaleSocket removes socket file at path if nothing accepts connections on it anymore
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and is not a unix socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s is already in use", path)
+	}
+	logger.Debugf("Removing stale unix socket %s", path)
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package sshbox
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// createUnixSocket creates socket in a private directory of path's parent, sets its mode and only then moves it
+// to path, so that socket is never reachable by others with a more permissive mode
+func createUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sshbox-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// socket file is moved, it is removed by its final path on close
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, mode)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixSocketListener{UnixListener: listener, path: path}, nil
+}
+
+// unixSocketListener removes socket file at path when closed
+type unixSocketListener struct {
+	*net.UnixListener
+	path      string
+	closeOnce sync.Once
+}
+
+func (l *unixSocketListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	l.closeOnce.Do(func() {
+		os.Remove(l.path)
+	})
+	return err
+}
@@ -0,0 +1,20 @@
+package sshbox
+
+import (
+	"net"
+	"os"
+)
+
+// createUnixSocket listens on a unix socket at path, permission of unix sockets are not enforced on windows
+func createUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
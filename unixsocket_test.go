@@ -0,0 +1,72 @@
+//go:build !windows
+// +build !windows
+
+package sshbox
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnixSocket(path, 0660)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("expected socket mode 0660, got %s", info.Mode().Perm())
+	}
+	if listener.Addr().String() != path {
+		t.Errorf("expected listener address %s, got %s", path, listener.Addr())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only socket in %s, got %d entries", dir, len(entries))
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial moved socket: %s", err)
+	}
+	reply := make([]byte, 2)
+	_, err = conn.Read(reply)
+	conn.Close()
+	if err != nil || string(reply) != "ok" {
+		t.Errorf("expected reply from listener, got %q %v", reply, err)
+	}
+
+	_, err = listenUnixSocket(path, 0600)
+	if err == nil {
+		t.Errorf("expected an error for a socket in use")
+	}
+
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected socket to be removed on close, got %v", err)
+	}
+}
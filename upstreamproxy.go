@@ -0,0 +1,165 @@
+package sshbox
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialer returns a dialer going through Proxy, or through ALL_PROXY when ProxyFromEnvironment is set,
+// connections to proxy are made with forward. Hosts matching NO_PROXY are dialed directly when ProxyFromEnvironment is set.
+func (c SSHConf) proxyDialer(forward *net.Dialer) (Dialer, error) {
+	proxyRaw := c.Proxy
+	if proxyRaw == "" && c.ProxyFromEnvironment {
+		proxyRaw = getenvAny("ALL_PROXY", "all_proxy")
+	}
+	if proxyRaw == "" {
+		return forward.DialContext, nil
+	}
+	proxyURL, err := url.Parse(proxyRaw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy url: %s", err)
+	}
+	var proxyDialer proxy.Dialer
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		proxyDialer, err = proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, err
+		}
+	case "http", "https":
+		proxyDialer = &httpProxyDialer{proxyURL: proxyURL, forward: forward}
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %s, must be one of http, https, socks5 or socks5h", proxyURL.Scheme)
+	}
+	if noProxy := getenvAny("NO_PROXY", "no_proxy"); c.ProxyFromEnvironment && noProxy != "" {
+		perHost := proxy.NewPerHost(proxyDialer, forward)
+		perHost.AddFromString(noProxy)
+		proxyDialer = perHost
+	}
+	return proxyDialer.(proxy.ContextDialer).DialContext, nil
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// httpProxyDialer opens connections through an http or https proxy with CONNECT method
+type httpProxyDialer struct {
+	proxyURL *url.URL
+	forward  *net.Dialer
+}
+
+func (d *httpProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxyURL.Host
+	if d.proxyURL.Port() == "" {
+		port := "80"
+		if d.proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxyURL.Hostname(), port)
+	}
+	rawConn, err := d.forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	return connContext(ctx, rawConn, func() (net.Conn, error) {
+		return d.connect(ctx, rawConn, addr)
+	})
+}
+
+// connect asks proxy to connect to addr
+func (d *httpProxyDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if d.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxyURL.Hostname()})
+		err := tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Failed tls handshake with proxy %s: %s", d.proxyURL.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxyURL.User != nil {
+		password, _ := d.proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Proxy %s refused connection to %s: %s", d.proxyURL.Host, addr, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// connContext runs exchange on conn and aborts it when context is done, conn is closed on failure
+func connContext(ctx context.Context, conn net.Conn, exchange func() (net.Conn, error)) (net.Conn, error) {
+	// deadline in the past unblocks reads and writes
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	result, err := exchange()
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// bufferedConn is a net.Conn whose first bytes have already been read in reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,190 @@
+package sshbox
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/ArthurHlt/go-socks5"
+)
+
+// testProxyRecorder records destinations and credentials seen by a test proxy
+type testProxyRecorder struct {
+	mu           sync.Mutex
+	destinations []string
+	credentials  []string
+}
+
+func (r *testProxyRecorder) record(destination, credentials string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.destinations = append(r.destinations, destination)
+	r.credentials = append(r.credentials, credentials)
+}
+
+func (r *testProxyRecorder) seen() ([]string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.destinations...), append([]string{}, r.credentials...)
+}
+
+// Valid records socks5 credentials and accepts user:password
+func (r *testProxyRecorder) Valid(user, password string) bool {
+	r.record("", user+":"+password)
+	return user == "user" && password == "password"
+}
+
+func newTestConnectProxy(t *testing.T) (*httptest.Server, *testProxyRecorder) {
+	t.Helper()
+	recorder := &testProxyRecorder{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		recorder.record(r.Host, r.Header.Get("Proxy-Authorization"))
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			conn.Close()
+			target.Close()
+			return
+		}
+		testPipe(conn, target)
+	}))
+	t.Cleanup(server.Close)
+	return server, recorder
+}
+
+func newTestSocks5Proxy(t *testing.T) (string, *testProxyRecorder) {
+	t.Helper()
+	recorder := &testProxyRecorder{}
+	server, err := socks5.New(&socks5.Config{
+		Credentials: recorder,
+		Logger:      log.New(io.Discard, "", 0),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			recorder.record(addr, "")
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+	return listener.Addr().String(), recorder
+}
+
+func dialTestSSH(t *testing.T, conf SSHConf) error {
+	t.Helper()
+	client, err := DefaultSshClientFactory(conf)
+	if err != nil {
+		return err
+	}
+	client.Close()
+	return nil
+}
+
+func TestUpstreamProxyHTTPConnect(t *testing.T) {
+	sshServer := newTestSSHServer(t)
+	proxyServer, recorder := newTestConnectProxy(t)
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	proxyURL.User = url.UserPassword("user", "password")
+
+	conf := sshServer.conf()
+	conf.Proxy = proxyURL.String()
+	err := dialTestSSH(t, conf)
+	if err != nil {
+		t.Fatalf("ssh through http proxy: %s", err)
+	}
+	destinations, credentials := recorder.seen()
+	if len(destinations) != 1 || destinations[0] != sshServer.addr() {
+		t.Fatalf("expected proxy to connect to %s, got %v", sshServer.addr(), destinations)
+	}
+	// base64 of user:password
+	if credentials[0] != "Basic dXNlcjpwYXNzd29yZA==" {
+		t.Errorf("expected basic proxy credentials, got %q", credentials[0])
+	}
+}
+
+func TestUpstreamProxySocks5(t *testing.T) {
+	sshServer := newTestSSHServer(t)
+	proxyAddr, recorder := newTestSocks5Proxy(t)
+
+	conf := sshServer.conf()
+	conf.Proxy = "socks5://user:password@" + proxyAddr
+	err := dialTestSSH(t, conf)
+	if err != nil {
+		t.Fatalf("ssh through socks5 proxy: %s", err)
+	}
+	destinations, credentials := recorder.seen()
+	if len(destinations) != 2 || credentials[0] != "user:password" || destinations[1] != sshServer.addr() {
+		t.Fatalf("expected proxy to authenticate user:password then dial %s, got %v %v", sshServer.addr(), credentials, destinations)
+	}
+
+	conf.Proxy = "socks5://user:wrong@" + proxyAddr
+	err = dialTestSSH(t, conf)
+	if err == nil {
+		t.Errorf("expected an error with invalid socks5 credentials")
+	}
+}
+
+func TestUpstreamProxyFromEnvironment(t *testing.T) {
+	sshServer := newTestSSHServer(t)
+	proxyServer, recorder := newTestConnectProxy(t)
+	t.Setenv("ALL_PROXY", proxyServer.URL)
+	t.Setenv("NO_PROXY", "")
+
+	conf := sshServer.conf()
+	conf.ProxyFromEnvironment = true
+	err := dialTestSSH(t, conf)
+	if err != nil {
+		t.Fatalf("ssh through ALL_PROXY: %s", err)
+	}
+	destinations, _ := recorder.seen()
+	if len(destinations) != 1 {
+		t.Fatalf("expected ALL_PROXY to be used, got %v", destinations)
+	}
+
+	host, _, _ := net.SplitHostPort(sshServer.addr())
+	t.Setenv("NO_PROXY", "example.com,"+host)
+	err = dialTestSSH(t, conf)
+	if err != nil {
+		t.Fatalf("ssh bypassing ALL_PROXY: %s", err)
+	}
+	destinations, _ = recorder.seen()
+	if len(destinations) != 1 {
+		t.Errorf("expected host in NO_PROXY to bypass proxy, got %v", destinations)
+	}
+
+	// proxy is only taken from environment when asked
+	conf.ProxyFromEnvironment = false
+	t.Setenv("NO_PROXY", "")
+	err = dialTestSSH(t, conf)
+	if err != nil {
+		t.Fatalf("ssh without proxy: %s", err)
+	}
+	destinations, _ = recorder.seen()
+	if len(destinations) != 1 {
+		t.Errorf("expected ALL_PROXY to be ignored, got %v", destinations)
+	}
+}
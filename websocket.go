@@ -0,0 +1,108 @@
+package sshbox
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/websocket"
+)
+
+// SshClientFactoryWebSocket makes a factory establishing ssh over a websocket (ws:// or wss:// url),
+// header is sent with websocket handshake, e.g. to pass an auth token to an ingress.
+// Websocket server is reached from BindAddress or BindInterface and through upstream Proxy if set,
+// Host of ssh conf is only used to verify host key.
+func SshClientFactoryWebSocket(wsURL string, header http.Header) SshClientFactoryContext {
+	return func(ctx context.Context, conf SSHConf) (*ssh.Client, error) {
+		dialer, err := conf.dialer()
+		if err != nil {
+			return nil, err
+		}
+		return NewSSHClientWithDialer(ctx, conf, func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialWebSocket(ctx, dialer, wsURL, header)
+		})
+	}
+}
+
+// DialWebSocket opens a websocket with binary frames on connection opened by dialer, it can be used as a net.Conn
+func DialWebSocket(ctx context.Context, dialer Dialer, wsURL string, header http.Header) (net.Conn, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid websocket url: %s", err)
+	}
+	var origin, port string
+	switch u.Scheme {
+	case "ws":
+		origin, port = "http://"+u.Host, "80"
+	case "wss":
+		origin, port = "https://"+u.Host, "443"
+	default:
+		return nil, fmt.Errorf("Unsupported websocket scheme %s, must be ws or wss", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	config, err := websocket.NewConfig(wsURL, origin)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		config.Header[key] = values
+	}
+
+	conn, err := dialer(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	return connContext(ctx, conn, func() (net.Conn, error) {
+		rwc := conn
+		if u.Scheme == "wss" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+			err := tlsConn.HandshakeContext(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("Failed tls handshake with %s: %s", u.Host, err)
+			}
+			rwc = tlsConn
+		}
+		ws, err := websocket.NewClient(config, rwc)
+		if err != nil {
+			return nil, fmt.Errorf("Failed websocket handshake with %s: %s", u.Host, err)
+		}
+		ws.PayloadType = websocket.BinaryFrame
+		return ws, nil
+	})
+}
+
+// WebSocketBridge returns an http handler bridging each websocket to a new tcp connection to target,
+// an ssh server address, to be used with SshClientFactoryWebSocket.
+// It does not authenticate clients, wrap it in a handler checking credentials if needed.
+func WebSocketBridge(target string) http.Handler {
+	return websocket.Server{
+		// clients are not browsers, origin is not checked
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			conn, err := net.Dial("tcp", target)
+			if err != nil {
+				logger.Warningf("WebSocket bridge failed to connect to %s: %s", target, err)
+				return
+			}
+			defer conn.Close()
+			entry := logger.WithField("remote", ws.Request().RemoteAddr)
+			entry.Debugf("WebSocket bridged to %s", target)
+			go func() {
+				io.Copy(conn, ws)
+				conn.Close()
+			}()
+			io.Copy(ws, conn)
+			entry.Debugf("WebSocket bridge to %s closed", target)
+		},
+	}
+}
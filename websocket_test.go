@@ -0,0 +1,62 @@
+package sshbox
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSshClientFactoryWebSocket(t *testing.T) {
+	server := newTestSSHServer(t)
+	tokens := make(chan string, 10)
+	bridge := WebSocketBridge(server.addr())
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tokens <- req.Header.Get("X-Token")
+		bridge.ServeHTTP(w, req)
+	}))
+	defer wsServer.Close()
+
+	wsURL := "ws://" + wsServer.Listener.Addr().String() + "/ssh"
+	header := http.Header{"X-Token": []string{"secret"}}
+	box, err := NewSSHBox(server.conf(), OptSSHClientFactoryContext(SshClientFactoryWebSocket(wsURL, header)))
+	if err != nil {
+		t.Fatalf("NewSSHBox over websocket: %s", err)
+	}
+	defer box.Close()
+	if token := <-tokens; token != "secret" {
+		t.Errorf("expected header to be sent with websocket handshake, got %q", token)
+	}
+
+	session, err := box.SSHClient().NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := session.Output("echo hello")
+	if err != nil || string(output) != "hello\n" {
+		t.Errorf("expected command output over websocket, got %q %v", output, err)
+	}
+}
+
+func TestDialWebSocketUnsupportedScheme(t *testing.T) {
+	dialed := false
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return nil, nil
+	}
+	_, err := DialWebSocket(context.Background(), dialer, "http://127.0.0.1/ssh", nil)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported websocket scheme") {
+		t.Errorf("expected unsupported scheme error, got %v", err)
+	}
+	if dialed {
+		t.Errorf("expected nothing to be dialed for an unsupported scheme")
+	}
+
+	server := newTestSSHServer(t)
+	_, err = SshClientFactoryWebSocket("tcp://"+server.addr(), nil)(context.Background(), server.conf())
+	if err == nil {
+		t.Errorf("expected factory to fail with an unsupported scheme")
+	}
+}
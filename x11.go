@@ -0,0 +1,304 @@
+package sshbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const x11AuthProtocol = "MIT-MAGIC-COOKIE-1"
+
+// X11Conf configures X11 forwarding of a session
+type X11Conf struct {
+	// Display is the local X display, defaults to DISPLAY environment variable
+	Display string
+	// XAuthorityFile holds cookie of local display, defaults to XAUTHORITY environment variable or ~/.Xauthority
+	XAuthorityFile string
+	// SingleConnection only forwards the first X11 connection of the session
+	SingleConnection bool
+	// ScreenNumber is the screen sent to server, defaults to screen of Display when nil
+	ScreenNumber *int
+}
+
+type x11Display struct {
+	network string
+	address string
+	number  string
+	screen  int
+}
+
+// x11Cookie is a fake cookie given to server and what it stands for locally
+type x11Cookie struct {
+	session          *ssh.Session
+	display          x11Display
+	realCookie       []byte
+	singleConnection bool
+}
+
+// SessionX11Forwarding returns a session option requesting X11 forwarding on session, X11 connections opened by
+// server are forwarded to local display. As OpenSSH does, server is given a fake cookie which is replaced by the real one
+// of local display. Fake cookie is forgotten when session is closed with CloseSession.
+// Sessions of InteractiveSSH and CommanderSSH request it by themselves when SSHConf.ForwardX11 is set.
+func (t *SSHBox) SessionX11Forwarding(conf X11Conf) SSHSessionOptions {
+	return func(session *ssh.Session) error {
+		displayName := conf.Display
+		if displayName == "" {
+			displayName = os.Getenv("DISPLAY")
+		}
+		if displayName == "" {
+			return fmt.Errorf("X11 forwarding needs DISPLAY to be set")
+		}
+		display, err := parseX11Display(displayName)
+		if err != nil {
+			return err
+		}
+		realCookie, err := readXAuthCookie(conf.xAuthorityFile(), display)
+		if err != nil {
+			logger.Warningf("No X11 cookie found for display %s, forwarding without authentication: %s", displayName, err)
+		}
+		fakeCookie := make([]byte, 16)
+		_, err = rand.Read(fakeCookie)
+		if err != nil {
+			return err
+		}
+		screen := display.screen
+		if conf.ScreenNumber != nil {
+			screen = *conf.ScreenNumber
+		}
+
+		err = t.registerX11Forwarding(t.SSHClient(), fakeCookie, x11Cookie{
+			session:          session,
+			display:          display,
+			realCookie:       realCookie,
+			singleConnection: conf.SingleConnection,
+		})
+		if err != nil {
+			return err
+		}
+		ok, err := session.SendRequest("x11-req", true, ssh.Marshal(struct {
+			SingleConnection bool
+			AuthProtocol     string
+			AuthCookie       string
+			ScreenNumber     uint32
+		}{conf.SingleConnection, x11AuthProtocol, hex.EncodeToString(fakeCookie), uint32(screen)}))
+		if err == nil && !ok {
+			err = fmt.Errorf("X11 forwarding request refused by server")
+		}
+		if err != nil {
+			t.releaseX11Forwarding(session)
+			return err
+		}
+		return nil
+	}
+}
+
+func (c X11Conf) xAuthorityFile() string {
+	if c.XAuthorityFile != "" {
+		return expandHome(c.XAuthorityFile)
+	}
+	if file := os.Getenv("XAUTHORITY"); file != "" {
+		return file
+	}
+	return expandHome("~/.Xauthority")
+}
+
+// registerX11Forwarding makes client accept x11 channels opened by server, once per client
+func (t *SSHBox) registerX11Forwarding(client *ssh.Client, fakeCookie []byte, cookie x11Cookie) error {
+	t.x11Mu.Lock()
+	defer t.x11Mu.Unlock()
+	if t.x11Client != client {
+		channels := client.HandleChannelOpen("x11")
+		if channels == nil {
+			return fmt.Errorf("x11 channels are already handled on ssh client")
+		}
+		t.x11Client = client
+		t.x11Cookies = make(map[string]x11Cookie)
+		go func() {
+			for newChannel := range channels {
+				go t.handleX11Channel(newChannel)
+			}
+		}()
+	}
+	t.x11Cookies[string(fakeCookie)] = cookie
+	return nil
+}
+
+// releaseX11Forwarding forgets fake cookies given to server for session, its X11 connections are rejected afterwards
+func (t *SSHBox) releaseX11Forwarding(session *ssh.Session) {
+	t.x11Mu.Lock()
+	defer t.x11Mu.Unlock()
+	for fakeCookie, cookie := range t.x11Cookies {
+		if cookie.session == session {
+			delete(t.x11Cookies, fakeCookie)
+		}
+	}
+}
+
+func (t *SSHBox) handleX11Channel(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		logger.Warningf("Failed to accept X11 channel: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	defer channel.Close()
+
+	// connection setup: byte order, pad, major and minor versions, auth protocol name and data lengths, pad
+	header := make([]byte, 12)
+	_, err = io.ReadFull(channel, header)
+	if err != nil {
+		logger.Debugf("Failed to read X11 connection setup: %s", err)
+		return
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if header[0] == 'B' {
+		order = binary.BigEndian
+	}
+	nameLen := int(order.Uint16(header[6:8]))
+	dataLen := int(order.Uint16(header[8:10]))
+	auth := make([]byte, x11Pad(nameLen)+x11Pad(dataLen))
+	_, err = io.ReadFull(channel, auth)
+	if err != nil {
+		logger.Debugf("Failed to read X11 connection setup: %s", err)
+		return
+	}
+	authName := string(auth[:nameLen])
+	authData := auth[x11Pad(nameLen) : x11Pad(nameLen)+dataLen]
+
+	t.x11Mu.Lock()
+	cookie, ok := t.x11Cookies[string(authData)]
+	if ok && cookie.singleConnection {
+		delete(t.x11Cookies, string(authData))
+	}
+	t.x11Mu.Unlock()
+	if !ok || authName != x11AuthProtocol {
+		logger.Warningf("X11 connection rejected because of wrong authentication")
+		return
+	}
+
+	conn, err := net.Dial(cookie.display.network, cookie.display.address)
+	if err != nil {
+		logger.Warningf("Failed to connect to X11 display %s: %s", cookie.display.address, err)
+		return
+	}
+	defer conn.Close()
+
+	setup := &bytes.Buffer{}
+	setup.Write(header[:6])
+	if len(cookie.realCookie) == 0 {
+		binary.Write(setup, order, [3]uint16{0, 0, 0})
+	} else {
+		binary.Write(setup, order, [3]uint16{uint16(len(x11AuthProtocol)), uint16(len(cookie.realCookie)), 0})
+		setup.Write(x11PadBytes([]byte(x11AuthProtocol)))
+		setup.Write(x11PadBytes(cookie.realCookie))
+	}
+	_, err = conn.Write(setup.Bytes())
+	if err != nil {
+		logger.Warningf("Failed to write to X11 display %s: %s", cookie.display.address, err)
+		return
+	}
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+	io.Copy(channel, conn)
+}
+
+func x11Pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+func x11PadBytes(b []byte) []byte {
+	return append(b, make([]byte, x11Pad(len(b))-len(b))...)
+}
+
+// parseX11Display parses display as [host]:number[.screen], unix socket path is used when host is empty or "unix"
+func parseX11Display(display string) (x11Display, error) {
+	idx := strings.LastIndex(display, ":")
+	if idx < 0 {
+		return x11Display{}, fmt.Errorf("Invalid X11 display %s", display)
+	}
+	host := display[:idx]
+	number := display[idx+1:]
+	screen := 0
+	if dot := strings.Index(number, "."); dot >= 0 {
+		var err error
+		screen, err = strconv.Atoi(number[dot+1:])
+		if err != nil {
+			return x11Display{}, fmt.Errorf("Invalid X11 display %s", display)
+		}
+		number = number[:dot]
+	}
+	num, err := strconv.Atoi(number)
+	if err != nil {
+		return x11Display{}, fmt.Errorf("Invalid X11 display %s", display)
+	}
+	switch {
+	case strings.HasPrefix(display, "/"):
+		// socket path given by launchd on macOS, e.g. /private/tmp/com.apple.launchd.xxx/org.xquartz:0
+		return x11Display{network: "unix", address: display[:idx+1+len(number)], number: number, screen: screen}, nil
+	case host == "" || host == "unix":
+		return x11Display{network: "unix", address: fmt.Sprintf("/tmp/.X11-unix/X%d", num), number: number, screen: screen}, nil
+	default:
+		return x11Display{network: "tcp", address: net.JoinHostPort(host, strconv.Itoa(6000+num)), number: number, screen: screen}, nil
+	}
+}
+
+// readXAuthCookie finds MIT-MAGIC-COOKIE-1 of display in an Xauthority file, entries for local host are preferred
+func readXAuthCookie(file string, display x11Display) ([]byte, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	var found []byte
+	reader := bytes.NewReader(content)
+	readField := func() ([]byte, error) {
+		var length uint16
+		err := binary.Read(reader, binary.BigEndian, &length)
+		if err != nil {
+			return nil, err
+		}
+		field := make([]byte, length)
+		_, err = io.ReadFull(reader, field)
+		return field, err
+	}
+	for reader.Len() > 0 {
+		var family uint16
+		err := binary.Read(reader, binary.BigEndian, &family)
+		if err != nil {
+			return nil, err
+		}
+		fields := make([][]byte, 4)
+		for i := range fields {
+			fields[i], err = readField()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Xauthority file %s: %s", file, err)
+			}
+		}
+		address, number, name, data := fields[0], fields[1], fields[2], fields[3]
+		if string(number) != display.number || string(name) != x11AuthProtocol {
+			continue
+		}
+		// 256 is FamilyLocal, addressed by hostname
+		if family == 256 && string(address) == hostname {
+			return data, nil
+		}
+		if found == nil {
+			found = data
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no %s entry for display %s in %s", x11AuthProtocol, display.number, file)
+	}
+	return found, nil
+}
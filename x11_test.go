@@ -0,0 +1,165 @@
+package sshbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestX11Display listens on a unix socket as a fake X display, cookies of connection setups are sent to returned channel
+func newTestX11Display(t *testing.T, dir string) (string, <-chan []byte) {
+	t.Helper()
+	socketPath := filepath.Join(dir, "X:0")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	cookies := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, 12)
+			_, err = io.ReadFull(conn, header)
+			if err == nil {
+				nameLen := int(binary.LittleEndian.Uint16(header[6:8]))
+				dataLen := int(binary.LittleEndian.Uint16(header[8:10]))
+				auth := make([]byte, x11Pad(nameLen)+x11Pad(dataLen))
+				_, err = io.ReadFull(conn, auth)
+				if err == nil {
+					cookies <- auth[x11Pad(nameLen) : x11Pad(nameLen)+dataLen]
+					conn.Write([]byte("ok"))
+				}
+			}
+			conn.Close()
+		}
+	}()
+	return socketPath, cookies
+}
+
+func writeTestXAuthority(t *testing.T, path string, number string, cookie []byte) {
+	t.Helper()
+	hostname, _ := os.Hostname()
+	content := &bytes.Buffer{}
+	binary.Write(content, binary.BigEndian, uint16(256))
+	for _, field := range [][]byte{[]byte(hostname), []byte(number), []byte(x11AuthProtocol), cookie} {
+		binary.Write(content, binary.BigEndian, uint16(len(field)))
+		content.Write(field)
+	}
+	err := os.WriteFile(path, content.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openTestX11Channel opens an x11 channel from server side and sends a little endian connection setup with cookie,
+// it returns what is read until channel is closed
+func openTestX11Channel(t *testing.T, server *testSSHServer, cookie []byte) []byte {
+	t.Helper()
+	channel, reqs, err := server.lastConn().OpenChannel("x11", ssh.Marshal(struct {
+		OriginAddr string
+		OriginPort uint32
+	}{"127.0.0.1", 6010}))
+	if err != nil {
+		t.Fatalf("open x11 channel: %s", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	defer channel.Close()
+	setup := &bytes.Buffer{}
+	setup.Write([]byte{'l', 0, 11, 0, 0, 0})
+	binary.Write(setup, binary.LittleEndian, [3]uint16{uint16(len(x11AuthProtocol)), uint16(len(cookie)), 0})
+	setup.Write(x11PadBytes([]byte(x11AuthProtocol)))
+	setup.Write(x11PadBytes(append([]byte{}, cookie...)))
+	_, err = channel.Write(setup.Bytes())
+	if err != nil {
+		t.Fatalf("write x11 setup: %s", err)
+	}
+	result := make(chan []byte, 1)
+	go func() {
+		content, _ := io.ReadAll(channel)
+		result <- content
+	}()
+	select {
+	case content := <-result:
+		return content
+	case <-time.After(5 * time.Second):
+		t.Fatalf("x11 channel not closed")
+		return nil
+	}
+}
+
+func TestX11Forwarding(t *testing.T) {
+	server := newTestSSHServer(t)
+	box, err := NewSSHBox(server.conf())
+	if err != nil {
+		t.Fatalf("NewSSHBox: %s", err)
+	}
+	defer box.Close()
+
+	dir := t.TempDir()
+	socketPath, displayCookies := newTestX11Display(t, dir)
+	realCookie := []byte("0123456789abcdef")
+	xAuthorityFile := filepath.Join(dir, "Xauthority")
+	writeTestXAuthority(t, xAuthorityFile, "0", realCookie)
+
+	session, err := box.SSHClient().NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	screen := 0
+	err = box.SessionX11Forwarding(X11Conf{
+		Display:        socketPath + ".1",
+		XAuthorityFile: xAuthorityFile,
+		ScreenNumber:   &screen,
+	})(session)
+	if err != nil {
+		t.Fatalf("x11 forwarding: %s", err)
+	}
+	request := <-server.x11Requests
+	if request.AuthProtocol != x11AuthProtocol || request.ScreenNumber != 0 {
+		t.Errorf("unexpected x11 request %+v", request)
+	}
+	fakeCookie, err := hex.DecodeString(request.AuthCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(fakeCookie, realCookie) {
+		t.Fatalf("real cookie must not be given to server")
+	}
+
+	reply := openTestX11Channel(t, server, fakeCookie)
+	if string(reply) != "ok" {
+		t.Fatalf("expected connection to reach display, got %q", reply)
+	}
+	if cookie := <-displayCookies; !bytes.Equal(cookie, realCookie) {
+		t.Errorf("expected fake cookie to be replaced by %q, got %q", realCookie, cookie)
+	}
+
+	reply = openTestX11Channel(t, server, []byte("fedcba9876543210"))
+	if len(reply) != 0 {
+		t.Errorf("expected connection with wrong cookie to be rejected, got %q", reply)
+	}
+
+	err = box.CloseSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = openTestX11Channel(t, server, fakeCookie)
+	if len(reply) != 0 {
+		t.Errorf("expected cookie of closed session to be rejected, got %q", reply)
+	}
+	if len(displayCookies) != 0 {
+		t.Errorf("expected only one connection to reach display")
+	}
+}